@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// anonymizeTokenPattern matches string literals and identifiers
+var anonymizeTokenPattern = regexp.MustCompile("\"(?:[^\"\\\\]|\\\\.)*\"|'(?:[^'\\\\]|\\\\.)*'|`[^`]*`|[A-Za-z_][A-Za-z0-9_]*")
+
+// diffHeaderPrefixes are diff lines that describe the change rather than
+// contain code, so --anonymize leaves them alone. They're only headers before
+// a file's first hunk: after it, "--- x" is a removed line "-- x".
+var diffHeaderPrefixes = []string{
+	"diff --git ", "index ", "--- ", "+++ ", "new file mode", "deleted file mode",
+	"old mode", "new mode", "similarity index", "dissimilarity index", "rename from",
+	"rename to", "copy from", "copy to", "Binary files", `\ No newline`,
+}
+
+// anonymizeKeywords are kept as is so the model can still see the structure
+// of the code. It's a mix of the common keywords of popular languages.
+var anonymizeKeywords = map[string]bool{}
+
+func init() {
+	for _, keyword := range strings.Fields(`
+		break case catch class const continue def default defer delete do elif else
+		enum export extends false finally fn for from func function go goto if impl
+		import in interface is let map match mod new nil none None not null or and
+		package pass private protected pub public raise return select self static
+		struct super switch this throw throws trait true True False try type typeof
+		undefined use var void while with yield async await lambda chan range mut
+		int string bool float float64 int64 byte error any object`) {
+		anonymizeKeywords[keyword] = true
+	}
+}
+
+// anonymizer replaces identifiers and string literals with placeholders,
+// mapping each distinct one to the same placeholder throughout the diff
+type anonymizer struct {
+	names    map[string]string
+	literals map[string]string
+}
+
+func newAnonymizer() *anonymizer {
+	return &anonymizer{names: make(map[string]string), literals: make(map[string]string)}
+}
+
+func (a *anonymizer) replace(code string) string {
+	return anonymizeTokenPattern.ReplaceAllStringFunc(code, func(token string) string {
+		switch token[0] {
+		case '"', '\'', '`':
+			placeholder, ok := a.literals[token]
+			if !ok {
+				placeholder = fmt.Sprintf("%cstr%d%c", token[0], len(a.literals)+1, token[0])
+				a.literals[token] = placeholder
+			}
+			return placeholder
+		}
+		if anonymizeKeywords[token] {
+			return token
+		}
+		placeholder, ok := a.names[token]
+		if !ok {
+			placeholder = fmt.Sprintf("id%d", len(a.names)+1)
+			a.names[token] = placeholder
+		}
+		return placeholder
+	})
+}
+
+// anonymizeDiff replaces identifiers and string literals in the code of a
+// diff with placeholders like id3 and "str2", keeping file names, keywords,
+// punctuation and the +/- structure. It's best effort: numbers and file
+// paths still get through.
+func anonymizeDiff(diff string) string {
+	return newAnonymizer().diff(diff)
+}
+
+// diff anonymizes a diff or part of one, reusing the placeholders from
+// earlier calls
+func (a *anonymizer) diff(diff string) string {
+	lines := strings.Split(diff, "\n")
+	// inBody is set once a file's headers end, at its first hunk or, for the
+	// raw contents of new files, after the +++ line
+	inBody := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "diff --git ") {
+			inBody = false
+		}
+		switch {
+		case !inBody && hasAnyPrefix(line, diffHeaderPrefixes):
+			inBody = strings.HasPrefix(line, "+++ ")
+		case strings.HasPrefix(line, `\ No newline`):
+		case strings.HasPrefix(line, "@@"):
+			inBody = true
+			// Keep the line numbers, but the function name after them is code
+			if end := strings.Index(line[2:], "@@"); end >= 0 {
+				end += 4
+				lines[i] = line[:end] + a.replace(line[end:])
+			}
+		case strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") || strings.HasPrefix(line, " "):
+			lines[i] = line[:1] + a.replace(line[1:])
+		default:
+			// Raw contents of new files
+			lines[i] = a.replace(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import "strings"
+
+// defaultAnthropicVersion is the anthropic-version header sent unless
+// --anthropic-version overrides it
+const defaultAnthropicVersion = "2023-06-01"
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type Thinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+type AnthropicRequest struct {
+	Model         string    `json:"model"`
+	MaxTokens     int       `json:"max_tokens"`
+	Messages      []Message `json:"messages"`
+	Thinking      *Thinking `json:"thinking,omitempty"`
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+	Temperature   *float64  `json:"temperature,omitempty"`
+}
+
+type AnthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicProvider struct {
+	apiKey string
+	usage  usage
+}
+
+func (p *anthropicProvider) LastUsage() usage {
+	return p.usage
+}
+
+// Complete calls the messages API and returns the text of the first text
+// block, skipping any thinking blocks
+func (p *anthropicProvider) Complete(model, prompt string, maxTokens int) (string, error) {
+	reqBody := AnthropicRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []Message{
+			{Role: "user", Content: prompt},
+		},
+		StopSequences: stopSequences,
+	}
+	if thinkingMode {
+		// max_tokens includes the thinking budget, so leave room for the answer
+		reqBody.Thinking = &Thinking{Type: "enabled", BudgetTokens: thinkingBudget}
+		reqBody.MaxTokens += thinkingBudget
+	} else {
+		// Extended thinking doesn't allow changing the temperature
+		reqBody.Temperature = cfg.Temperature
+	}
+
+	body, err := postJSON("https://api.anthropic.com/v1/messages", map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	var anthropicResp AnthropicResponse
+	if err := parseResponse(body, &anthropicResp); err != nil {
+		return "", err
+	}
+	p.usage = usage{
+		InputTokens:  anthropicResp.Usage.InputTokens,
+		OutputTokens: anthropicResp.Usage.OutputTokens,
+		Truncated:    anthropicResp.StopReason == "max_tokens",
+	}
+
+	for _, block := range anthropicResp.Content {
+		if block.Type == "thinking" || block.Type == "redacted_thinking" {
+			continue
+		}
+		return strings.TrimSpace(block.Text), nil
+	}
+	return "", errEmptyResponse
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+	"time"
+)
+
+// runBench implements the "bench" subcommand, which generates a message for
+// the staged diff with several models so they can be compared. It never
+// commits.
+func runBench(p Provider, providerName, model string, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	modelsFlag := fs.String("models", "", "Comma-separated models to compare (default: the current model, plus the ones (m)odel offers for the provider)")
+	parseFlags(fs, args)
+
+	models := splitList(*modelsFlag)
+	if len(models) == 0 {
+		models = []string{model}
+		selected, _ := lookupProvider(providerName)
+		for _, m := range selected.Models {
+			if m != model {
+				models = append(models, m)
+			}
+		}
+	}
+	if len(models) < 2 {
+		return fmt.Errorf("nothing to compare, pass at least two models with --models")
+	}
+
+	debug("Getting git diff for staged changes...")
+	diff, err := exec.Command("git", "diff", "--cached").Output()
+	if err != nil {
+		return fmt.Errorf("error getting git diff: %w", err)
+	}
+	if len(diff) == 0 {
+		return errNothingStaged
+	}
+	recentCommits, err := recentCommitMessages()
+	if err != nil {
+		debug("Skipping recent commits, git log failed: %v", err)
+	}
+
+	promptDiff, notes := preparePromptDiff(string(diff), stagedSanitizer())
+	prompt := buildPrompt(string(recentCommits), promptDiff, notes)
+	tokens := estimateTokens(prompt)
+	if err := checkPromptSize(tokens); err != nil {
+		return err
+	}
+	for _, m := range models {
+		if err := checkMessageCost(providerName, m, tokens); err != nil {
+			return err
+		}
+	}
+
+	type result struct {
+		model   string
+		message string
+		elapsed time.Duration
+		usage   usage
+		err     error
+	}
+	var results []result
+	for _, m := range models {
+		info("Generating with %s...", m)
+		start := time.Now()
+		msg, err := generateMessage(p, m, prompt)
+		r := result{model: m, message: msg, elapsed: time.Since(start), err: err}
+		if err == nil {
+			r.message = postProcess(msg)
+			r.usage, _ = lastUsage(p)
+		}
+		results = append(results, r)
+	}
+
+	for _, r := range results {
+		fmt.Printf("=== %s (%s)\n", r.model, r.elapsed.Round(time.Millisecond))
+		if r.err != nil {
+			fmt.Printf("Error: %v\n\n", r.err)
+			continue
+		}
+		fmt.Printf("%s\n\n", r.message)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tLATENCY\tINPUT TOKENS\tOUTPUT TOKENS")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "%s\t%s\tfailed\t\n", r.model, r.elapsed.Round(time.Millisecond))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", r.model, r.elapsed.Round(time.Millisecond), r.usage.InputTokens, r.usage.OutputTokens)
+	}
+	return w.Flush()
+}
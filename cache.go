@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheEntry is a generated message stored by --cache
+type cacheEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// cacheKey hashes everything that affects the generated message, so a
+// changed diff, model or provider misses the cache
+func cacheKey(provider, model, prompt string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%t\x00%s", provider, model, refineMode, prompt))))
+}
+
+// cachePath returns the cache file for a key under the user cache directory
+func cachePath(key string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "commit", key+".json"), nil
+}
+
+// cachedMessage returns the message cached under key if it's younger than
+// ttl. Any problem reading the cache is treated as a miss.
+func cachedMessage(key string, ttl time.Duration) (string, bool) {
+	path, err := cachePath(key)
+	if err != nil {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		debug("Ignoring unreadable cache file %s: %v", path, err)
+		return "", false
+	}
+	if time.Since(entry.Time) > ttl {
+		debug("Cache entry %s has expired", path)
+		return "", false
+	}
+	return entry.Message, true
+}
+
+// storeMessage caches a generated message. Failing to write the cache
+// doesn't stop the commit, so errors are only logged.
+func storeMessage(key, message string) {
+	path, err := cachePath(key)
+	if err != nil {
+		debug("Not caching message: %v", err)
+		return
+	}
+	data, err := json.Marshal(cacheEntry{Time: time.Now(), Message: message})
+	if err != nil {
+		debug("Not caching message: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		debug("Not caching message: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		debug("Not caching message: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lastTag returns the most recent tag reachable from HEAD, or "" if there
+// are no tags
+func lastTag() string {
+	output, err := exec.Command("git", "describe", "--tags", "--abbrev=0").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// changelog generates a markdown changelog from the commits since the last
+// tag, or from the whole history if there are no tags yet
+func changelog(p Provider, providerName, model string) (string, error) {
+	revRange := "HEAD"
+	if tag := lastTag(); tag != "" {
+		revRange = tag + "..HEAD"
+	}
+
+	debug("Getting commits in %s...", revRange)
+	commits, err := exec.Command("git", "log", "--pretty=format:%h %B", revRange).Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting commits in %s: %w", revRange, err)
+	}
+	if len(bytes.TrimSpace(commits)) == 0 {
+		return "", fmt.Errorf("no commits found in %s", revRange)
+	}
+
+	prompt := fmt.Sprintf(`Write a markdown changelog for a release from the git commits below.
+
+Group entries under headings such as "### Features", "### Fixes", "### Performance", "### Documentation" and "### Other", omitting empty groups. Use the conventional commit type of each commit to pick its group.
+Write one terse bullet per user-facing change, merging commits that describe the same change. Leave out purely internal noise like merge commits.
+
+Return ONLY the changelog - no introduction, no explanation.
+
+Commits (hash followed by message):
+%s`, string(commits))
+	if err := checkPrompt(providerName, model, prompt, 2000); err != nil {
+		return "", err
+	}
+
+	return complete(p, model, prompt, 2000)
+}
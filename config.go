@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Config holds settings from the config file, which lives at
+// $XDG_CONFIG_HOME/commit/config.json (or the platform equivalent) unless
+// COMMIT_AI_CONFIG points elsewhere
+type Config struct {
+	// Provider and Model are used when no flag, environment variable or git
+	// config sets them
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	// MaxTokens is the token budget for a message, Temperature the sampling
+	// temperature (the API's default if unset) and Language the language the
+	// message is written in (English if unset)
+	MaxTokens   int      `json:"max_tokens"`
+	Temperature *float64 `json:"temperature"`
+	Language    string   `json:"language"`
+	// Footers are added to every message as "Key: Value" trailers
+	Footers map[string]string `json:"footers"`
+	// FooterTemplate is the default for --footer-template
+	FooterTemplate string `json:"footer_template"`
+	// DefaultAction is the default for --default-action
+	DefaultAction string `json:"default_action"`
+	// Types replaces the default list of conventional commit types
+	Types []string `json:"types"`
+	// EnforceTypes turns on --enforce-types
+	EnforceTypes bool `json:"enforce_types"`
+	// RejectGeneric turns on --reject-generic, and GenericPhrases replaces
+	// the default list of subjects it rejects
+	RejectGeneric  bool     `json:"reject_generic"`
+	GenericPhrases []string `json:"generic_phrases"`
+	// Imperative turns on --imperative
+	Imperative bool `json:"imperative"`
+	// EmojiMap maps types to the emoji --emoji puts in front of the subject,
+	// on top of the default gitmoji
+	EmojiMap map[string]string `json:"emoji_map"`
+	// TestPatterns and LowPriorityPatterns replace the default patterns used
+	// to decide which files to leave out of an oversized diff first
+	TestPatterns        []string `json:"test_patterns"`
+	LowPriorityPatterns []string `json:"low_priority_patterns"`
+	// Examples replace the example messages in the prompt. ExamplesFile
+	// adds more from a file, separated by lines of "---"; a relative path is
+	// relative to the config file.
+	Examples     []string `json:"examples"`
+	ExamplesFile string   `json:"examples_file"`
+	// Profiles are named sets of the settings above, selected with --profile
+	Profiles map[string]json.RawMessage `json:"profiles"`
+}
+
+var cfg Config
+
+func configPath() (string, error) {
+	if path := os.Getenv("COMMIT_AI_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "commit", "config.json"), nil
+}
+
+// loadConfig reads the config file, returning an empty config if it doesn't
+// exist
+func loadConfig() (Config, error) {
+	var c Config
+	path, err := configPath()
+	if err != nil {
+		return c, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		debug("No config file at %s", path)
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	debug("Loading config from %s", path)
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// applyProfile lays the named profile's settings over the top level ones.
+// Settings the profile doesn't mention keep their top level values, lists
+// replace them and maps (e.g. footers) add to them. The profile's own
+// settings are returned too, since they outrank the environment and git
+// config.
+func applyProfile(c Config, name string) (Config, Config, error) {
+	raw, ok := c.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return c, Config{}, fmt.Errorf("no profile %q, the config file has no profiles", name)
+		}
+		return c, Config{}, fmt.Errorf("no profile %q in the config file (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	merged := c
+	if err := json.Unmarshal(raw, &merged); err != nil {
+		return c, Config{}, fmt.Errorf("error parsing profile %q: %w", name, err)
+	}
+	var own Config
+	if err := json.Unmarshal(raw, &own); err != nil {
+		return c, Config{}, fmt.Errorf("error parsing profile %q: %w", name, err)
+	}
+	return merged, own, nil
+}
+
+// loadExamples returns the configured example messages for the prompt, or
+// nil to use the built-in ones
+func loadExamples(c Config) ([]string, error) {
+	examples := c.Examples
+	if c.ExamplesFile == "" {
+		return examples, nil
+	}
+
+	path := c.ExamplesFile
+	if !filepath.IsAbs(path) {
+		if cfgPath, err := configPath(); err == nil {
+			path = filepath.Join(filepath.Dir(cfgPath), path)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading examples_file: %w", err)
+	}
+	for _, example := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n---\n") {
+		if example = strings.TrimSpace(example); example != "" {
+			examples = append(examples, example)
+		}
+	}
+	return examples, nil
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultTestPatterns match test files, which matter less than the code
+// they test when the diff has to be trimmed
+var defaultTestPatterns = []string{"*_test.go", "*.test.*", "*.spec.*", "test_*.py", "test/", "tests/", "__tests__/", "testdata/"}
+
+// defaultLowPriorityPatterns match generated, vendored and lock files, which
+// rarely explain a change
+var defaultLowPriorityPatterns = []string{"go.sum", "*.lock", "*-lock.json", "*.min.js", "*.min.css", "*.map", "*.pb.go", "*_generated.*", "*.gen.*", "vendor/", "node_modules/", "dist/"}
+
+// matchesPattern reports whether p matches a pattern. Patterns ending in "/"
+// match any file under a directory of that name; others are globs matched
+// against the full path and the file name.
+func matchesPattern(pattern, p string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/"); ok {
+		return strings.HasPrefix(p, dir+"/") || strings.Contains(p, "/"+dir+"/")
+	}
+	if ok, _ := path.Match(pattern, p); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(p))
+	return ok
+}
+
+func matchesAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matchesPattern(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filePriority ranks a file by how likely it is to explain the change:
+// 0 for source, 1 for tests and 2 for generated or vendored files
+func filePriority(p string) int {
+	lowPriority := defaultLowPriorityPatterns
+	if len(cfg.LowPriorityPatterns) > 0 {
+		lowPriority = cfg.LowPriorityPatterns
+	}
+	testPatterns := defaultTestPatterns
+	if len(cfg.TestPatterns) > 0 {
+		testPatterns = cfg.TestPatterns
+	}
+
+	switch {
+	case matchesAny(lowPriority, p):
+		return 2
+	case matchesAny(testPatterns, p):
+		return 1
+	}
+	return 0
+}
+
+// prioritizeDiff keeps whole files, most important first, until the diff
+// fits in budget bytes. It returns the trimmed diff and the paths of the
+// files that were left out.
+func prioritizeDiff(diff string, budget int) (string, []string) {
+	if budget <= 0 || len(diff) <= budget {
+		return diff, nil
+	}
+
+	files := splitDiff(diff)
+	sort.SliceStable(files, func(i, j int) bool {
+		return filePriority(diffPath(files[i])) < filePriority(diffPath(files[j]))
+	})
+
+	var kept strings.Builder
+	var omitted []string
+	for _, file := range files {
+		if kept.Len()+len(file) > budget {
+			omitted = append(omitted, diffPath(file))
+			continue
+		}
+		kept.WriteString(file)
+	}
+
+	// If even the most important file doesn't fit, send as much of it as we can
+	if kept.Len() == 0 && len(files) > 0 {
+		kept.WriteString(files[0][:budget])
+		kept.WriteString("\n... (truncated)\n")
+		omitted = omitted[1:]
+	}
+	return kept.String(), omitted
+}
+
+// largeFiles returns the paths, in diff order, whose diff (including any
+// appended file contents) is larger than limit bytes
+func largeFiles(diff string, limit int) []string {
+	sizes := make(map[string]int)
+	var paths []string
+	for _, file := range splitDiff(diff) {
+		p := diffPath(file)
+		if _, ok := sizes[p]; !ok {
+			paths = append(paths, p)
+		}
+		sizes[p] += len(file)
+	}
+
+	var large []string
+	for _, p := range paths {
+		if p != "" && sizes[p] > limit {
+			large = append(large, p)
+		}
+	}
+	return large
+}
+
+// truncateFileLines limits each file in the diff to maxLines lines of hunks,
+// so one huge file can't crowd out the rest
+func truncateFileLines(diff string, maxLines int) string {
+	if maxLines <= 0 {
+		return diff
+	}
+
+	var out strings.Builder
+	for _, file := range splitDiff(diff) {
+		lines := strings.SplitAfter(strings.TrimSuffix(file, "\n"), "\n")
+
+		// The header runs up to the first hunk (or the "+++" line for file
+		// contents appended without hunks)
+		bodyStart := len(lines)
+		hasHunks := false
+		for i, line := range lines {
+			if strings.HasPrefix(line, "@@") {
+				bodyStart = i + 1
+				hasHunks = true
+				break
+			}
+			if strings.HasPrefix(line, "+++ ") {
+				bodyStart = i + 1
+			}
+		}
+
+		body := lines[bodyStart:]
+		if len(body) <= maxLines {
+			out.WriteString(file)
+			continue
+		}
+
+		// Appended file contents have no +/- markers, so every line counts
+		changed := 0
+		for _, line := range body[maxLines:] {
+			if !hasHunks || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+				changed++
+			}
+		}
+		out.WriteString(strings.Join(lines[:bodyStart+maxLines], ""))
+		if !strings.HasSuffix(out.String(), "\n") {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "... %d more lines changed\n", changed)
+	}
+	return out.String()
+}
+
+// diffFiles returns the paths in a diff in order, each listed once
+func diffFiles(diff string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, file := range splitDiff(diff) {
+		path := diffPath(file)
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// excludeFiles drops the given files from the diff
+func excludeFiles(diff string, excluded map[string]bool) string {
+	var kept strings.Builder
+	for _, file := range splitDiff(diff) {
+		if !excluded[diffPath(file)] {
+			kept.WriteString(file)
+		}
+	}
+	return kept.String()
+}
+
+const (
+	ignoreStartMarker = "commit:ignore-start"
+	ignoreEndMarker   = "commit:ignore-end"
+
+	ignoredPlaceholder = "[lines left out by commit:ignore]"
+)
+
+// hunkHeaderPattern reads the first old and new line numbers of a hunk
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// diffSanitizer prepares diffs for prompts: CRLFs become LFs, invalid UTF-8
+// is replaced and the lines inside commit:ignore-start ... commit:ignore-end
+// regions are left out, with a placeholder so the model knows something was.
+// Every prompt built from a diff goes through it, usually via sanitizeDiff.
+//
+// A hunk often shows only part of a region, without its markers, so when the
+// two sides of the diff can be read with git show, the regions are found in
+// the files themselves and mapped onto the hunks' line numbers. Otherwise
+// only regions whose markers are in the diff are found.
+type diffSanitizer struct {
+	// sides says the old and new files can be read at oldRev and newRev,
+	// where "" for newRev is the index
+	sides          bool
+	oldRev, newRev string
+	regions        map[string]map[int]bool    // by "rev:path"
+	marked         map[string]map[string]bool // files with markers, by rev
+	dropped        int                        // lines left out so far
+}
+
+// stagedSanitizer cleans diffs of the staged changes
+func stagedSanitizer() *diffSanitizer {
+	return &diffSanitizer{sides: true, oldRev: "HEAD"}
+}
+
+// revSanitizer cleans diffs between two revisions
+func revSanitizer(oldRev, newRev string) *diffSanitizer {
+	return &diffSanitizer{sides: true, oldRev: oldRev, newRev: newRev}
+}
+
+// rangeSanitizer cleans the diff of a revision range like a..b or a...b,
+// which git diff takes from the merge base. Other ranges compare with the
+// working tree, which git show can't read.
+func rangeSanitizer(revRange string) *diffSanitizer {
+	from, to, threeDots := strings.Cut(revRange, "...")
+	if !threeDots {
+		var ok bool
+		if from, to, ok = strings.Cut(revRange, ".."); !ok {
+			return &diffSanitizer{}
+		}
+	}
+	// An empty side is HEAD
+	if from == "" {
+		from = "HEAD"
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+	if threeDots {
+		base, err := exec.Command("git", "merge-base", from, to).Output()
+		if err != nil {
+			return &diffSanitizer{}
+		}
+		from = strings.TrimSpace(string(base))
+	}
+	return revSanitizer(from, to)
+}
+
+func (s *diffSanitizer) clean(diff string) string {
+	diff = strings.ToValidUTF8(normalizeNewlines(diff), "\uFFFD")
+	if !s.sides && !strings.Contains(diff, ignoreStartMarker) {
+		return diff
+	}
+
+	var kept []string
+	var oldIgnored, newIgnored map[int]bool
+	// mapped says the file's regions were read with git show
+	inHunk, inMarkers, mapped, lastDropped := false, false, false, false
+	oldLine, newLine := 0, 0
+	for _, line := range strings.Split(diff, "\n") {
+		drop := false
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			oldIgnored, newIgnored = nil, nil
+			inHunk, inMarkers, mapped = false, false, false
+		case !inHunk && strings.HasPrefix(line, "--- a/"):
+			var ok bool
+			oldIgnored, ok = s.ignoredLines(s.oldRev, strings.TrimPrefix(line, "--- a/"))
+			mapped = mapped || ok
+		case !inHunk && strings.HasPrefix(line, "+++ b/"):
+			var ok bool
+			newIgnored, ok = s.ignoredLines(s.newRev, strings.TrimPrefix(line, "+++ b/"))
+			mapped = mapped || ok
+		case strings.HasPrefix(line, "@@"):
+			if m := hunkHeaderPattern.FindStringSubmatch(line); m != nil {
+				oldLine, _ = strconv.Atoi(m[1])
+				newLine, _ = strconv.Atoi(m[2])
+				inHunk = true
+			}
+		case inHunk && strings.HasPrefix(line, "-"):
+			drop = oldIgnored[oldLine]
+			oldLine++
+		case inHunk && strings.HasPrefix(line, "+"):
+			drop = newIgnored[newLine]
+			newLine++
+		case inHunk && strings.HasPrefix(line, " "):
+			drop = oldIgnored[oldLine] || newIgnored[newLine]
+			oldLine++
+			newLine++
+		}
+
+		// Otherwise regions are found from their markers in the diff, e.g. in
+		// the contents of new files, which have no hunks. A region without an
+		// end runs to the end of its file.
+		if inHunk && mapped {
+			inMarkers = false
+		} else if !inMarkers && strings.Contains(line, ignoreStartMarker) {
+			inMarkers = true
+		}
+		if inMarkers {
+			drop = true
+			inMarkers = !strings.Contains(line, ignoreEndMarker)
+		}
+
+		if drop {
+			s.dropped++
+			if !lastDropped {
+				kept = append(kept, ignoredPlaceholder)
+			}
+		} else {
+			kept = append(kept, line)
+		}
+		lastDropped = drop
+	}
+	return strings.Join(kept, "\n")
+}
+
+// ignoredLines returns the lines inside regions of the file at rev:path,
+// reading each file once, and whether the file could be read
+func (s *diffSanitizer) ignoredLines(rev, path string) (map[int]bool, bool) {
+	if !s.sides {
+		return nil, false
+	}
+	key := rev + ":" + path
+	if lines, ok := s.regions[key]; ok {
+		return lines, lines != nil
+	}
+	if s.regions == nil {
+		s.regions = make(map[string]map[int]bool)
+	}
+	if marked := s.markedFiles(rev); marked != nil && !marked[path] {
+		s.regions[key] = map[int]bool{}
+		return s.regions[key], true
+	}
+	content, err := exec.Command("git", "show", key).Output()
+	if err != nil {
+		debug("Could not read %s to find commit:ignore regions: %v", key, err)
+		s.regions[key] = nil
+		return nil, false
+	}
+	lines := regionLines(string(content))
+	s.regions[key] = lines
+	return lines, true
+}
+
+// markedFiles lists the files at rev (or in the index for "") containing a
+// start marker with one git grep, so the others needn't be read. It returns
+// nil if git grep fails.
+func (s *diffSanitizer) markedFiles(rev string) map[string]bool {
+	if marked, ok := s.marked[rev]; ok {
+		return marked
+	}
+	if s.marked == nil {
+		s.marked = make(map[string]map[string]bool)
+	}
+	args := []string{"grep", "-l", "-F", "-e", ignoreStartMarker}
+	if rev == "" {
+		args = append(args, "--cached")
+	} else {
+		args = append(args, rev)
+	}
+	// Paths are relative to the top like the diff's
+	cmd := exec.Command("git", append([]string{"-c", "grep.fullName=true"}, args...)...)
+	if root, err := repoRoot(); err == nil {
+		cmd.Dir = root
+	}
+	output, err := cmd.Output()
+	var marked map[string]bool
+	// git grep exits with 1 when nothing matches
+	var exitErr *exec.ExitError
+	if err == nil || errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		marked = make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			if rev != "" {
+				line = strings.TrimPrefix(line, rev+":")
+			}
+			if line != "" {
+				marked[line] = true
+			}
+		}
+	} else {
+		debug("git grep for commit:ignore markers failed: %v", err)
+	}
+	s.marked[rev] = marked
+	return marked
+}
+
+// regionLines returns the numbers (from 1) of the lines of content inside
+// commit:ignore regions, markers included. A region without an end runs to
+// the end of the file.
+func regionLines(content string) map[int]bool {
+	lines := make(map[int]bool)
+	if !strings.Contains(content, ignoreStartMarker) {
+		return lines
+	}
+	ignoring := false
+	for i, line := range strings.Split(strings.TrimSuffix(normalizeNewlines(content), "\n"), "\n") {
+		if !ignoring && strings.Contains(line, ignoreStartMarker) {
+			ignoring = true
+		}
+		if ignoring {
+			lines[i+1] = true
+			ignoring = !strings.Contains(line, ignoreEndMarker)
+		}
+	}
+	return lines
+}
+
+// sanitizeDiff prepares a whole diff for a prompt with s
+func sanitizeDiff(diff string, s *diffSanitizer) string {
+	diff = s.clean(diff)
+	if s.dropped > 0 {
+		debug("Left out %d lines in commit:ignore regions", s.dropped)
+	}
+	return diff
+}
+
+// changedBytes counts the bytes on added and removed lines, ignoring the
+// headers and context that make even tiny diffs look large
+func changedBytes(diff string) int {
+	n := 0
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "+++ ") || strings.HasPrefix(line, "--- ") {
+			continue
+		}
+		if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			n += len(line) - 1
+		}
+	}
+	return n
+}
+
+// trivialMessage is the local message used for changes below
+// --min-diff-bytes
+func trivialMessage(paths []string) string {
+	t := trivialType(paths)
+	if len(paths) == 1 {
+		return t + ": minor edits to " + paths[0]
+	}
+	return fmt.Sprintf("%s: minor edits in %d files", t, len(paths))
+}
+
+// trivialType guesses the type of a trivial change from the files it
+// touches: docs if they're all documentation, test if they're all tests,
+// and chore otherwise
+func trivialType(paths []string) string {
+	docs, tests := len(paths) > 0, len(paths) > 0
+	for _, p := range paths {
+		docs = docs && (matchesAny([]string{"*.md", "*.rst", "*.adoc", "docs/", "doc/"}, p) || strings.HasPrefix(path.Base(p), "LICENSE"))
+		tests = tests && filePriority(p) == 1
+	}
+	switch {
+	case docs:
+		return "docs"
+	case tests:
+		return "test"
+	}
+	return "chore"
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+)
+
+// Exit codes, so scripts wrapping commit can tell outcomes apart. They're
+// documented in the README and shouldn't change meaning.
+const (
+	exitOK          = 0   // committed, or printed what was asked for
+	exitError       = 1   // any other error
+	exitNoChanges   = 2   // nothing is staged
+	exitAPIError    = 3   // the provider's API failed or returned nothing
+	exitAborted     = 4   // the user rejected the message or declined a prompt
+	exitUsage       = 5   // invalid flags or flag values
+	exitGitNotFound = 127 // like a shell's "command not found"
+)
+
+var (
+	// errNothingStaged means there are no staged changes to describe
+	errNothingStaged = errors.New("no staged changes found")
+	// errAborted means the user declined to go on
+	errAborted = errors.New("aborted")
+)
+
+// usageError is an error caused by an invalid flag value found after the
+// flags were parsed, like an unknown provider
+type usageError struct{ error }
+
+func (e usageError) Unwrap() error { return e.error }
+
+// exitCodeFor picks the exit code for an error returned by a subcommand or
+// one of the generation steps
+func exitCodeFor(err error) int {
+	var apiErr *apiError
+	var urlErr *url.Error
+	var usageErr usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errNothingStaged):
+		return exitNoChanges
+	case errors.Is(err, errAborted):
+		return exitAborted
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.As(err, &apiErr), errors.As(err, &urlErr), errors.Is(err, errEmptyResponse), errors.Is(err, errCutOffResponse):
+		return exitAPIError
+	}
+	return exitError
+}
+
+// parseFlags parses args with fs, which must use flag.ContinueOnError, and
+// exits with exitUsage on bad flags. The flag package would exit with 2,
+// which means "no staged changes" here.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+}
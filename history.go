@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historyEntry records one generated message and what the user did with it
+type historyEntry struct {
+	Time    time.Time `json:"time"`
+	Repo    string    `json:"repo"`
+	Branch  string    `json:"branch"`
+	Model   string    `json:"model"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Final   string    `json:"final,omitempty"`
+	// Type and FinalType are the conventional commit types of Message and
+	// Final, to see how often edits change the model's choice
+	Type      string `json:"type,omitempty"`
+	FinalType string `json:"final_type,omitempty"`
+}
+
+// maxHistorySamples caps how many past messages --style-from history uses
+const maxHistorySamples = 5
+
+// historyPath returns $XDG_STATE_HOME/commit/history.jsonl, defaulting to
+// ~/.local/state
+func historyPath() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "commit", "history.jsonl"), nil
+}
+
+// recordHistory appends an entry to the history file. History is a nicety,
+// so failures are only reported in debug output.
+func recordHistory(entry historyEntry) {
+	if noHistory {
+		return
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		debug("Not recording history: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		debug("Not recording history: %v", err)
+		return
+	}
+
+	entry.Time = time.Now()
+	// Messages are recorded as shown, so skip any --prefix and emoji to find
+	// the type
+	_, message := splitDecoration(entry.Message)
+	entry.Type = commitType(message)
+	if entry.Final != "" {
+		_, final := splitDecoration(entry.Final)
+		entry.FinalType = commitType(final)
+	}
+	if root, err := repoRoot(); err == nil {
+		entry.Repo = root
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		debug("Not recording history: %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		debug("Not recording history: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		debug("Not recording history: %v", err)
+	}
+}
+
+// acceptedMessages returns the last messages accepted or edited in this repo,
+// newest first, using the edited version where there is one. They reflect the
+// user's own style better than git log, which has everyone's commits.
+func acceptedMessages(limit int) ([]string, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Repo != root {
+			continue
+		}
+		switch {
+		case entry.Status == "edited" && entry.Final != "":
+			messages = append(messages, entry.Final)
+		case entry.Status == "accepted":
+			messages = append(messages, entry.Message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var newest []string
+	for i := len(messages) - 1; i >= 0 && len(newest) < limit; i-- {
+		newest = append(newest, messages[i])
+	}
+	return newest, nil
+}
@@ -1,104 +1,2399 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
+	"crypto/sha1"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// runningEnv is set for the git commit we run, so a --hook in the
+// prepare-commit-msg hook knows to leave the message alone
+const runningEnv = "COMMIT_AI_RUNNING"
+
+const defaultModel = "claude-3-5-haiku-latest"
+
+// defaultStopSequences cut off the explanations models sometimes add after
+// the message, while still allowing a multi-line body
+var defaultStopSequences = []string{"\n\nExplanation:", "\n\nNote:", "\n\nThis commit message"}
+
+// defaultCommitTypes are the conventional commit types used unless --types or
+// the config file say otherwise
+var defaultCommitTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+// defaultGenericPhrases are subjects too vague to be useful, rejected by
+// --reject-generic unless the config file's generic_phrases replaces them
+var defaultGenericPhrases = []string{"update", "update files", "update code", "changes", "minor changes", "small changes", "fix bug", "fix bugs", "fix issues", "various fixes", "minor fixes", "improvements", "code cleanup", "misc", "wip"}
+
+// commitVerbs are verbs commit subjects commonly start with. --imperative
+// only flags a first word that's one of these plus -s, -ed or -ing ("adds",
+// "fixed", "using"), since most other such words are nouns or adjectives
+// ("typos", "nested", "logging"). Verbs that are as often nouns, like "test"
+// and "change", are left out.
+var commitVerbs = map[string]bool{
+	"add": true, "adjust": true, "allow": true, "apply": true, "avoid": true, "bump": true, "clean": true, "convert": true,
+	"create": true, "deprecate": true, "disable": true, "drop": true, "enable": true, "ensure": true, "expose": true,
+	"extract": true, "fix": true, "handle": true, "implement": true, "improve": true, "introduce": true, "make": true,
+	"migrate": true, "move": true, "prevent": true, "refactor": true, "remove": true, "rename": true, "replace": true,
+	"restore": true, "revert": true, "rewrite": true, "show": true, "simplify": true, "skip": true, "support": true,
+	"switch": true, "update": true, "upgrade": true, "use": true, "validate": true,
+}
+
+// verbEndings are the endings inflectedCommitVerb strips, with what to put
+// back to get the verb: "fixes" is "fix", "applied" is "apply" and "using"
+// is "use"
+var verbEndings = []struct{ suffix, replacement string }{
+	{"s", ""}, {"es", ""}, {"ies", "y"},
+	{"ed", ""}, {"d", ""}, {"ied", "y"},
+	{"ing", ""}, {"ing", "e"},
+}
+
+// defaultEmojiMap is the gitmoji for each type, used by --emoji unless the
+// config file's emoji_map overrides it
+var defaultEmojiMap = map[string]string{
+	"feat":     "✨",
+	"fix":      "🐛",
+	"docs":     "📝",
+	"style":    "🎨",
+	"refactor": "♻️",
+	"perf":     "⚡️",
+	"test":     "✅",
+	"build":    "📦",
+	"ci":       "👷",
+	"chore":    "🔧",
+	"revert":   "⏪",
+}
+
+var (
+	debugMode          bool
+	expectBranch       string
+	modelFlag          string
+	providerFlag       string
+	summarizeLongDiff  bool
+	summarizeThreshold int
+	minimalMode        bool
+	squashRange        string
+	thinkingMode       bool
+	thinkingBudget     int
+	signoff            bool
+	allowEmpty         bool
+	emptyNote          string
+	outputFile         string
+	dryRun             bool
+	pipeCommand        string
+	breakingChange     bool
+	changelogMode      bool
+	subjectCase        string
+	userContext        stringList
+	autoAccept         bool
+	quietMode          bool
+	maxInputTokens     int
+	typesFlag          string
+	commitTypes        []string
+	refineMode         bool
+	noNewFileContent   bool
+	checkSetup         bool
+	maxDiffBytes       int
+	hookFile           string
+	maxFileLines       int
+	noHistory          bool
+	rebaseMessageFile  string
+	autoSplit          bool
+	footerTemplate     string
+	providersFlag      string
+	useBranchContext   bool
+	useCache           bool
+	cacheTTL           time.Duration
+	stopFlag           stringList
+	stopSequences      []string
+	anonymizeMode      bool
+	subjectPrefix      string
+	subjectSuffix      string
+	contextCmd         string
+	defaultAction      string
+	selectMode         bool
+	apiKeys            stringList
+	minDiffBytes       int
+	maxBodyLines       int
+	styleFrom          string
+	diffFile           string
+	commitArgs         string
+	extraCommitArgs    []string
+	wordDiff           bool
+	stagedTree         string
+	enforceTypes       bool
+	appendMode         bool
+	skipContentExt     string
+	emojiMode          bool
+	emojiMap           map[string]string
+	summarizeLarge     bool
+	largeFileBytes     int
+	anthropicVersion   string
+	estimateMode       bool
+	costWarn           float64
+	pushMode           bool
+	gitVerbose         bool
+	dateFormat         string
+	profile            string
+	rejectGeneric      bool
+	listProvidersFlag  bool
+	fixedSubject       string
+	promptExamples     []string
+	imperativeMode     bool
 )
 
-var debugMode bool
+// stringList is a flag that can be repeated, collecting each value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// secrets holds values (like the API key) that must never appear in output
+var secrets []string
+
+var apiKeyPattern = regexp.MustCompile(`sk-ant-[A-Za-z0-9_\-]+`)
+
+// redactSecrets masks registered secrets and anything that looks like an
+// Anthropic API key, so debug output is safe to share
+func redactSecrets(s string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "[REDACTED]")
+		}
+	}
+	return apiKeyPattern.ReplaceAllString(s, "sk-ant-[REDACTED]")
+}
+
+func debug(format string, a ...interface{}) {
+	if debugMode && !quietMode {
+		fmt.Fprintln(os.Stderr, redactSecrets(fmt.Sprintf("DEBUG: "+format, a...)))
+	}
+}
+
+// defaultMaxTokens is the token budget for a commit message unless the config
+// file's max_tokens changes it
+const defaultMaxTokens = 300
+
+// messageMaxTokens returns the token budget for a commit message
+func messageMaxTokens() int {
+	if cfg.MaxTokens > 0 {
+		return cfg.MaxTokens
+	}
+	return defaultMaxTokens
+}
+
+// generateMessage asks the model for a commit message, refining it with a
+// second call when --refine is set
+func generateMessage(p Provider, model, prompt string) (string, error) {
+	msg, err := complete(p, model, prompt, messageMaxTokens())
+	if err != nil || !refineMode {
+		return msg, err
+	}
+	info("Refining the message (--refine)...")
+	return refineMessage(p, model, prompt, msg)
+}
+
+// checkMessageCost runs checkCost for generateMessage with a prompt of
+// promptTokens. The reply is at most messageMaxTokens, and --refine sends the
+// prompt again with room for a longer answer.
+func checkMessageCost(provider, model string, promptTokens int) error {
+	inputTokens, outputTokens := promptTokens, messageMaxTokens()
+	if refineMode {
+		inputTokens, outputTokens = 2*promptTokens, outputTokens+800
+	}
+	return checkCost(provider, model, inputTokens, outputTokens)
+}
+
+// refineMessage asks the model to critique a generated message against the
+// original instructions and return a tightened version. The original message
+// is kept if the reply can't be parsed.
+func refineMessage(p Provider, model, prompt, msg string) (string, error) {
+	refinePrompt := fmt.Sprintf(`You were given the instructions below and wrote the commit message that follows them. Critique that message strictly against the instructions: is the type right, is the subject specific and concise, are the bullets terse, accurate and free of fluff, is anything important missing or anything invented? Then write an improved version.
+
+Reply in exactly this format:
+CRITIQUE:
+<a few terse points>
+MESSAGE:
+<the improved commit message only>
+
+--- INSTRUCTIONS ---
+%s
+--- END INSTRUCTIONS ---
+
+--- YOUR MESSAGE ---
+%s
+--- END MESSAGE ---`, prompt, msg)
+
+	reply, err := complete(p, model, refinePrompt, 800)
+	if err != nil {
+		return "", err
+	}
+	critique, improved, ok := strings.Cut(reply, "MESSAGE:")
+	improved = strings.TrimSpace(improved)
+	if !ok || improved == "" {
+		debug("Could not parse refined message, keeping the original: %s", reply)
+		return msg, nil
+	}
+	debug("Critique: %s", strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(critique), "CRITIQUE:")))
+	return improved, nil
+}
+
+// checkProvider makes the cheapest possible request to confirm the key,
+// provider and model all work
+func checkProvider(p Provider, model string) error {
+	_, err := p.Complete(model, "Reply with OK.", 1)
+	if errors.Is(err, errEmptyResponse) {
+		// The request was accepted, the model just had no room to answer
+		return nil
+	}
+	return err
+}
+
+// complete sends a single-turn prompt to the model, retrying once if the API
+// succeeds but returns no content (usually a transient overload) or the
+// response was cut off
+func complete(p Provider, model, prompt string, maxTokens int) (string, error) {
+	msg, err := p.Complete(model, prompt, maxTokens)
+	if errors.Is(err, errEmptyResponse) || errors.Is(err, errCutOffResponse) {
+		debug("%v, retrying once...", err)
+		msg, err = p.Complete(model, prompt, maxTokens)
+	}
+	if u, ok := lastUsage(p); err == nil && ok && u.Truncated {
+		// A message cut off mid-sentence shouldn't be committed as is
+		debug("Response hit the %d token limit, retrying with %d...", maxTokens, maxTokens*4)
+		if retried, retryErr := p.Complete(model, prompt, maxTokens*4); retryErr == nil {
+			msg = retried
+		}
+		if u, _ := lastUsage(p); u.Truncated {
+			info("Warning: The reply hit the token limit and may be cut off, check it before accepting")
+		}
+	}
+	return msg, err
+}
+
+// info prints progress, warnings and other non-error output, which --quiet
+// suppresses
+func info(format string, a ...interface{}) {
+	if !quietMode {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+// stdin reads the answers to prompts a whole line at a time
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine prompts for a line of free text and returns it trimmed, keeping
+// its case. Once stdin is closed (e.g. Ctrl-D) nothing else can be answered,
+// so it exits rather than letting the caller prompt forever.
+func readLine(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr)
+		info("No more input, exiting.")
+		os.Exit(exitAborted)
+	}
+	return strings.TrimSpace(line)
+}
+
+// getInput reads a menu choice, lowercased so "A" works like "a"
+func getInput(prompt string) string {
+	return strings.ToLower(readLine(prompt))
+}
+
+// isInteractive reports whether stdin and stderr are terminals, which the
+// interactive prompt needs
+func isInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// confirm asks a yes/no question, defaulting to no
+func confirm(prompt string) bool {
+	choice := getInput(prompt)
+	return choice == "y" || choice == "yes"
+}
+
+func printSuggestion(commitMsg, summary string) {
+	fmt.Fprintf(os.Stderr, "\nSuggested commit message:\n------------------\n%s\n------------------\n", commitMsg)
+	fmt.Fprintln(os.Stderr, summary)
+	fmt.Fprintf(os.Stderr, "\nDo you want to (a)ccept, (e)dit, (m)odel, (c)ritique, (s)cope, or (r)eject this message? ")
+	if defaultAction != "" {
+		fmt.Fprintf(os.Stderr, "[%s] ", defaultAction)
+	}
+}
+
+// chooseModel asks the user to pick one of models by number or any model by
+// name, returning "" if they didn't pick one
+func chooseModel(models []string, current string) string {
+	fmt.Fprintf(os.Stderr, "\nCurrent model: %s\n", current)
+	for i, m := range models {
+		fmt.Fprintf(os.Stderr, "  %d) %s\n", i+1, m)
+	}
+	choice := getInput("Pick a model by number or enter a model name (blank to cancel): ")
+	if choice == "" {
+		return ""
+	}
+	if n, err := strconv.Atoi(choice); err == nil {
+		if n < 1 || n > len(models) {
+			fmt.Fprintln(os.Stderr, "Invalid model number.")
+			return ""
+		}
+		return models[n-1]
+	}
+	return choice
+}
+
+// selectFiles shows the staged files and lets the user toggle which ones are
+// left out of the prompt, returning the excluded ones
+func selectFiles(paths []string) map[string]bool {
+	excluded := make(map[string]bool)
+	for {
+		fmt.Fprintln(os.Stderr, "\nStaged files sent to the model:")
+		for i, path := range paths {
+			mark := "x"
+			if excluded[path] {
+				mark = " "
+			}
+			fmt.Fprintf(os.Stderr, "  %d. [%s] %s\n", i+1, mark, path)
+		}
+		choice := getInput("Enter numbers to toggle, or press Enter to continue: ")
+		if choice == "" {
+			return excluded
+		}
+		for _, field := range strings.FieldsFunc(choice, func(r rune) bool { return r == ',' || r == ' ' }) {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 1 || n > len(paths) {
+				fmt.Fprintf(os.Stderr, "Invalid file number %q.\n", field)
+				continue
+			}
+			excluded[paths[n-1]] = !excluded[paths[n-1]]
+		}
+	}
+}
+
+// gitEditor returns the editor git itself would use: GIT_EDITOR, core.editor,
+// VISUAL (unless the terminal is dumb), then EDITOR
+func gitEditor() string {
+	if editor := os.Getenv("GIT_EDITOR"); editor != "" {
+		return editor
+	}
+	if editor := gitConfig("core.editor"); editor != "" {
+		return editor
+	}
+	if editor := os.Getenv("VISUAL"); editor != "" && os.Getenv("TERM") != "dumb" {
+		return editor
+	}
+	if editor := os.Getenv("EDITOR"); editor != "" {
+		return editor
+	}
+	return "vim" // fallback to vim
+}
+
+func editMessage(initial string) (string, error) {
+	// Create temporary file
+	tmpfile, err := os.CreateTemp("", "commit-msg-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("could not create a temporary file for the editor (set TMPDIR to a writable directory): %w", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	// Write initial message to file
+	if _, err := tmpfile.WriteString(initial); err != nil {
+		return "", err
+	}
+	tmpfile.Close()
+
+	// Open editor. Like git, run it through the shell so it can have
+	// arguments (e.g. "code --wait").
+	editor := gitEditor()
+	debug("Editor: %s", editor)
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, tmpfile.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	// Read edited message
+	content, err := os.ReadFile(tmpfile.Name())
+	if err != nil {
+		return "", err
+	}
+	return normalizeNewlines(string(content)), nil
+}
+
+// writeOutput writes the message to the --output file, if one was given
+func writeOutput(message string) error {
+	if outputFile == "" {
+		return nil
+	}
+	content := withTrailingNewline(message)
+	if hookFile != "" {
+		// Keep the comments git puts in the message file (status, instructions)
+		content += hookComments(hookFile)
+	}
+	debug("Writing message to %s", outputFile)
+	return os.WriteFile(outputFile, []byte(content), 0644)
+}
+
+// hookComments returns the comment lines of the message file git passed to
+// the prepare-commit-msg hook, so they can be kept below the new message
+func hookComments(path string) string {
+	existing, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var comments strings.Builder
+	for _, line := range strings.SplitAfter(string(existing), "\n") {
+		if strings.HasPrefix(line, "#") {
+			comments.WriteString(line)
+		}
+	}
+	if comments.Len() == 0 {
+		return ""
+	}
+	return "\n" + comments.String()
+}
+
+// pushIfRequested pushes the new commit for --push. The commit is already
+// made, so a failed push is reported and exits, without undoing it.
+func pushIfRequested() {
+	if !pushMode || rebaseMessageFile != "" {
+		return
+	}
+	if err := pushCommit(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitError)
+	}
+}
+
+// pushCommit runs git push to the current branch's upstream, asking first
+// unless --yes was given
+func pushCommit() error {
+	upstream, err := exec.Command("git", "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}").Output()
+	if err != nil {
+		remote := "<remote>"
+		if output, err := exec.Command("git", "remote").Output(); err == nil {
+			if remotes := strings.Fields(string(output)); len(remotes) == 1 {
+				remote = remotes[0]
+			}
+		}
+		branch, _ := currentBranch()
+		return fmt.Errorf("the commit was made, but the branch has no upstream to push to. Push it and set one with: git push -u %s %s", remote, branch)
+	}
+	target := strings.TrimSpace(string(upstream))
+	if !autoAccept && !confirm(fmt.Sprintf("Push to %s? [y/N] ", target)) {
+		info("Not pushed.")
+		return nil
+	}
+
+	info("Pushing to %s...", target)
+	cmd := exec.Command("git", "push")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("the commit was made, but git push failed: %w", err)
+	}
+	info("Pushed to %s.", target)
+	return nil
+}
+
+// hookMessage returns the message git (or the user, with -m or a template)
+// already put in the hook's message file, without git's comment lines
+func hookMessage(path string) string {
+	existing, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var lines []string
+	for _, line := range strings.Split(string(existing), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// appendNote asks the model to build on an existing message for --append
+func appendNote(existing string) string {
+	return "A commit message was already started by the author (or by git, for merges). Refine or add to it rather than replacing it: keep what it says and any details, issue references or trailers in it, and use the diff to fill in what's missing. If it's already a complete conventional commit message, return it with only light fixes.\n\nExisting message:\n" + existing
+}
+
+// finishCommit writes the accepted message to --output (if set) and commits,
+// or saves it for git rebase --continue when a rebase is in progress
+func finishCommit(message string) error {
+	if err := writeOutput(message); err != nil {
+		return fmt.Errorf("error writing message: %w", err)
+	}
+	if rebaseMessageFile != "" {
+		debug("Writing message to %s", rebaseMessageFile)
+		if err := os.WriteFile(rebaseMessageFile, []byte(withTrailingNewline(message)), 0644); err != nil {
+			return fmt.Errorf("error writing rebase message: %w", err)
+		}
+		info("Message saved. Run git rebase --continue to commit it.")
+		return nil
+	}
+	if err := checkStagedUnchanged(); err != nil {
+		return err
+	}
+	if err := commitChanges(message); err != nil {
+		return err
+	}
+	info("Changes committed successfully!")
+	return nil
+}
+
+// writeStagedTree returns the tree object of the index, which identifies the
+// staged changes
+func writeStagedTree() (string, error) {
+	output, err := exec.Command("git", "write-tree").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// checkStagedUnchanged makes sure the index still holds the changes the
+// message was generated for, since another process may have staged or
+// unstaged files in the meantime. At the interactive prompt a change is only
+// a warning the user can accept, e.g. after re-staging files a pre-commit
+// hook fixed, and the accepted changes become the ones to check against.
+func checkStagedUnchanged() error {
+	if stagedTree == "" {
+		return nil
+	}
+	tree, err := writeStagedTree()
+	if err != nil {
+		debug("Could not re-check staged changes: %v", err)
+		return nil
+	}
+	if tree == stagedTree {
+		return nil
+	}
+	if !allowEmpty && exec.Command("git", "diff", "--cached", "--quiet").Run() == nil {
+		return fmt.Errorf("%w: the staged changes were removed after the message was generated. Stage them again and re-run commit", errNothingStaged)
+	}
+	if autoAccept {
+		return errors.New("the staged changes changed after the message was generated, so it may not describe them. Re-run commit to generate a new message")
+	}
+	info("Warning: The staged changes changed after the message was generated, so it may not describe them.")
+	if !confirm("Commit them with this message anyway? (y/N): ") {
+		return errors.New("not committed. (e)dit the message to describe the new staged changes, or accept again to commit them with this one")
+	}
+	stagedTree = tree
+	return nil
+}
+
+func commitChanges(message string) error {
+	debug("Running git commit")
+	// Catch CRLFs added after normalizeMessage, e.g. by a --pipe command
+	message = normalizeNewlines(message)
+	args := []string{"commit", "-m", message}
+
+	// Pass the message in a file where possible so long messages don't hit
+	// argument length limits, but a read-only or full temp dir shouldn't stop
+	// the commit
+	if tmpfile, err := os.CreateTemp("", "commit-msg-*.txt"); err != nil {
+		debug("Could not create temporary message file, using -m: %v", err)
+	} else {
+		defer os.Remove(tmpfile.Name())
+		_, err := tmpfile.WriteString(withTrailingNewline(message))
+		if closeErr := tmpfile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			debug("Could not write temporary message file, using -m: %v", err)
+		} else {
+			args = []string{"commit", "-F", tmpfile.Name()}
+		}
+	}
+	if allowEmpty {
+		args = append(args, "--allow-empty")
+	}
+	args = append(args, extraCommitArgs...)
+	debug("git %v", args)
+	commitCmd := exec.Command("git", args...)
+	// git runs prepare-commit-msg for our commit too, and a --hook there
+	// mustn't replace the message that was just accepted
+	commitCmd.Env = append(os.Environ(), runningEnv+"=1")
+	if gitVerbose || debugMode {
+		// Everything goes to stderr, like the rest of our progress output
+		commitCmd.Stdout = os.Stderr
+		commitCmd.Stderr = os.Stderr
+		if err := commitCmd.Run(); err != nil {
+			return fmt.Errorf("error running git commit: %w", err)
+		}
+		return nil
+	}
+	if output, err := commitCmd.CombinedOutput(); err != nil {
+		// Include git's output, since hook rejections are explained there
+		return fmt.Errorf("error running git commit: %w\n%s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// splitArgs splits a command line into arguments like a shell would, honoring
+// single quotes, double quotes and backslash escapes
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// checkAPIKey returns a warning if the key doesn't look like an Anthropic
+// key, or "" if it looks fine. It's only a hint; the key is still used.
+func checkAPIKey(key string) string {
+	switch {
+	case strings.TrimSpace(key) != key:
+		return "ANTHROPIC_API_KEY has leading or trailing whitespace (a stray newline from copy-paste?)"
+	case strings.ContainsAny(key, " \t\r\n"):
+		return "ANTHROPIC_API_KEY contains whitespace"
+	case !strings.HasPrefix(key, "sk-ant-"):
+		return "ANTHROPIC_API_KEY doesn't start with \"sk-ant-\", it may not be a valid Anthropic key"
+	}
+	return ""
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// gitConfig returns the value of a git config key, or "" if it isn't set
+func gitConfig(key string) string {
+	output, err := exec.Command("git", "config", "--get", key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// resolveSetting picks a setting by precedence: flag, then environment
+// variable, then git config, then the built-in default
+func resolveSetting(flagValue, envVar, gitKey, fallback string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if v := os.Getenv(envVar); v != "" {
+		return v
+	}
+	if v := gitConfig(gitKey); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// resolveModel picks the model for the selected provider: --model, then the
+// profile's, COMMIT_AI_MODEL, git config commit-ai.model, the config file's
+// and finally the provider's default. A configured model is meant for the
+// provider configured at the same level or below, so it's skipped when
+// something more specific (e.g. --provider) chose another provider, as the
+// model name would be rejected there.
+func resolveModel(selected providerInfo, profileCfg, baseCfg Config) string {
+	if modelFlag != "" {
+		return modelFlag
+	}
+	levels := []struct{ source, model, provider string }{
+		{"the profile", profileCfg.Model, profileCfg.Provider},
+		{"COMMIT_AI_MODEL", os.Getenv("COMMIT_AI_MODEL"), os.Getenv("COMMIT_AI_PROVIDER")},
+		{"git config commit-ai.model", gitConfig("commit-ai.model"), gitConfig("commit-ai.provider")},
+		{"the config file", baseCfg.Model, baseCfg.Provider},
+	}
+	for i, level := range levels {
+		if level.model == "" {
+			continue
+		}
+		intended := ""
+		for _, below := range levels[i:] {
+			if below.provider != "" {
+				intended = below.provider
+				break
+			}
+		}
+		// Without a provider setting, it's the one picked automatically
+		if intended == "" {
+			intended = providers[0].Name
+			if detected, ok := detectProvider(); ok && len(apiKeys) == 0 {
+				intended = detected.Name
+			}
+		}
+		if intended != selected.Name {
+			debug("Ignoring model %s from %s, it's for provider %s, not %s", level.model, level.source, intended, selected.Name)
+			continue
+		}
+		return level.model
+	}
+	return selected.DefaultModel
+}
+
+// postProcess normalizes a freshly generated message and applies subject
+// casing, the user's formatter and configured trailers
+func postProcess(message string) string {
+	if fixedSubject != "" {
+		// Unwrapped first, so a fence or introduction isn't kept as the body
+		message = withSubject(unwrapMessage(strings.TrimSpace(normalizeNewlines(message))), fixedSubject)
+	}
+	message = normalizeMessage(message)
+	message = limitBodyLines(message, maxBodyLines)
+	message = applySubjectCase(message, subjectCase)
+	if pipeCommand != "" {
+		message = pipeMessage(pipeCommand, message)
+	}
+	checkCommitType(message)
+	if emojiMode {
+		message = addEmoji(message, emojiMap)
+	}
+	message = wrapSubject(message, subjectPrefix, subjectSuffix)
+	return applyTrailers(message)
+}
+
+// addEmoji puts the emoji for the message's type in front of the subject.
+// Messages without a conventional type, or with a type that has no emoji,
+// are left alone.
+func addEmoji(message string, emojis map[string]string) string {
+	emoji := emojis[commitType(message)]
+	if emoji == "" {
+		return message
+	}
+	return emoji + " " + message
+}
+
+// withSubject puts the --subject line above the generated body, dropping a
+// subject line the model wrote anyway. Only a line with one of the commit
+// types counts, since a body may well start with e.g. "Note: ...".
+func withSubject(message, subject string) string {
+	first, body, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	first = strings.TrimSpace(first)
+	if first != subject && !slices.Contains(commitTypes, strings.ToLower(commitType(first))) {
+		body = message
+	}
+	if body = strings.TrimSpace(body); body == "" {
+		return subject
+	}
+	return subject + "\n\n" + body
+}
+
+// splitDecoration splits what --prefix and --emoji put in front of the
+// subject from the rest of the message, whose type can then be read again
+func splitDecoration(message string) (string, string) {
+	lead := ""
+	if subjectPrefix != "" && strings.HasPrefix(message, subjectPrefix) {
+		lead, message = subjectPrefix, strings.TrimPrefix(message, subjectPrefix)
+	}
+	for _, emoji := range emojiMap {
+		if emoji != "" && strings.HasPrefix(message, emoji+" ") {
+			return lead + emoji + " ", strings.TrimPrefix(message, emoji+" ")
+		}
+	}
+	return lead, message
+}
+
+// wrapSubject adds --prefix and --suffix to the subject line, unless it
+// already has them (e.g. copied from recent commits)
+func wrapSubject(message, prefix, suffix string) string {
+	subject, body, hasBody := strings.Cut(message, "\n")
+	if !strings.HasPrefix(subject, prefix) {
+		subject = prefix + subject
+	}
+	if !strings.HasSuffix(subject, suffix) {
+		subject += suffix
+	}
+	if !hasBody {
+		return subject
+	}
+	return subject + "\n" + body
+}
+
+// messagePreamble matches an introduction some models put before the
+// message, like "Here's the commit message:"
+var messagePreamble = regexp.MustCompile(`(?i)^(here('s| is)|sure|certainly)\b.*:$`)
+
+// normalizeMessage gives the message the canonical "subject\n\nbody" shape:
+// exactly one blank line between the subject and the body, and no blank
+// lines before the subject or after the body. An introduction, code fence or
+// quotes around the message are removed first.
+func normalizeMessage(message string) string {
+	lines := strings.Split(unwrapMessage(strings.TrimSpace(normalizeNewlines(message))), "\n")
+	subject := strings.TrimSpace(lines[0])
+
+	body := lines[1:]
+	for len(body) > 0 && strings.TrimSpace(body[0]) == "" {
+		body = body[1:]
+	}
+	if len(body) == 0 {
+		return subject
+	}
+	return subject + "\n\n" + strings.Join(body, "\n")
+}
+
+// unwrapMessage removes what models sometimes put around the message: an
+// introduction line, a code fence and quotes
+func unwrapMessage(message string) string {
+	if first, rest, ok := strings.Cut(message, "\n"); ok && messagePreamble.MatchString(strings.TrimSpace(first)) {
+		message = strings.TrimSpace(rest)
+	}
+	if len(message) >= 6 && strings.HasPrefix(message, "```") && strings.HasSuffix(message, "```") {
+		// The opening fence may name a language, e.g. ```text
+		_, inner, ok := strings.Cut(message, "\n")
+		if !ok {
+			inner = strings.TrimPrefix(message, "```")
+		}
+		message = strings.TrimSpace(strings.TrimSuffix(inner, "```"))
+	}
+	for _, quote := range []string{`"`, "'", "`"} {
+		inner, ok := strings.CutPrefix(message, quote)
+		if inner, ok2 := strings.CutSuffix(inner, quote); ok && ok2 && !strings.Contains(inner, quote) {
+			return strings.TrimSpace(inner)
+		}
+	}
+	return message
+}
+
+// normalizeNewlines turns CRLF (and lone CR) line endings into LF, so
+// Windows files and editors don't leave carriage returns in the prompt or in
+// the committed message
+func normalizeNewlines(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+// withTrailingNewline ends message with exactly one newline, however many
+// blank lines or spaces steps after normalizeMessage (trailers, a --pipe
+// command) left, so git log output stays clean
+func withTrailingNewline(message string) string {
+	return strings.TrimRight(message, " \t\r\n") + "\n"
+}
+
+// limitBodyLines keeps the subject and at most maxLines non-blank lines of
+// the body. A BREAKING CHANGE footer is always kept, since it matters more
+// than any bullet.
+func limitBodyLines(message string, maxLines int) string {
+	subject, body, ok := strings.Cut(message, "\n")
+	if maxLines <= 0 || !ok {
+		return message
+	}
+
+	var kept []string
+	count := 0
+	for _, line := range strings.Split(body, "\n") {
+		switch {
+		case strings.HasPrefix(line, "BREAKING CHANGE:") || strings.HasPrefix(line, "BREAKING-CHANGE:"):
+		case strings.TrimSpace(line) == "":
+			if len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+				continue
+			}
+		case count < maxLines:
+			count++
+		default:
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return normalizeMessage(subject + "\n" + strings.Join(kept, "\n"))
+}
+
+// subjectPattern splits a conventional commit subject into its
+// "type(scope)!: " prefix, the type and the description
+var subjectPattern = regexp.MustCompile(`^((\w+)(?:\([^)]*\))?!?:\s*)(.*)$`)
+
+// setScope replaces the scope of a conventional commit subject, removing it
+// when scope is empty. It fails if the subject has no conventional type.
+func setScope(message, scope string) (string, error) {
+	// The message may already have its --prefix and emoji
+	lead, message := splitDecoration(message)
+	subject, body, hasBody := strings.Cut(message, "\n")
+	m := subjectPattern.FindStringSubmatch(subject)
+	if m == nil {
+		return "", errors.New("the subject has no conventional commit type to add a scope to")
+	}
+	prefix := m[2]
+	if scope != "" {
+		prefix += "(" + scope + ")"
+	}
+	if strings.Contains(m[1], "!") {
+		prefix += "!"
+	}
+	subject = lead + prefix + ": " + m[3]
+	if hasBody {
+		subject += "\n" + body
+	}
+	return subject, nil
+}
+
+// suggestScope asks the model for a scope based on the message and the
+// changed files, which is much cheaper than sending the diff again
+func suggestScope(p Provider, model, message string, files []string) (string, error) {
+	prompt := fmt.Sprintf(`Suggest a conventional commit scope (the part in parentheses in "feat(scope): ...") for this commit, usually the module, package or area of the codebase it touches.
+
+Return ONLY the scope: a single short lowercase word, no parentheses, no explanation.
+
+Commit message:
+%s
+
+Changed files:
+%s`, message, strings.Join(files, "\n"))
+	scope, err := complete(p, model, prompt, 20)
+	if err != nil {
+		return "", err
+	}
+	words := strings.Fields(scope)
+	if len(words) == 0 {
+		return "", errEmptyResponse
+	}
+	return strings.Trim(words[0], "()`'\".:"), nil
+}
+
+// commitType returns the conventional commit type of the message's subject,
+// or "" if it doesn't have one
+func commitType(message string) string {
+	subject, _, _ := strings.Cut(message, "\n")
+	if m := subjectPattern.FindStringSubmatch(subject); m != nil {
+		return m[2]
+	}
+	return ""
+}
+
+// genericPhrase returns the generic phrase the message's subject consists of
+// (ignoring its type, case and punctuation), or "" if it's specific enough
+func genericPhrase(message string) string {
+	phrases := defaultGenericPhrases
+	if len(cfg.GenericPhrases) > 0 {
+		phrases = cfg.GenericPhrases
+	}
+	subject, _, _ := strings.Cut(message, "\n")
+	if m := subjectPattern.FindStringSubmatch(subject); m != nil {
+		subject = m[3]
+	}
+	subject = strings.ToLower(strings.Trim(subject, " .!"))
+	for _, phrase := range phrases {
+		if subject == strings.ToLower(strings.TrimSpace(phrase)) {
+			return phrase
+		}
+	}
+	return ""
+}
+
+// nonImperativeVerb returns the first word of the subject's description if
+// it's a known verb like "adds", "added" or "adding" rather than "add", or ""
+func nonImperativeVerb(message string) string {
+	subject, _, _ := strings.Cut(message, "\n")
+	if m := subjectPattern.FindStringSubmatch(subject); m != nil {
+		subject = m[3]
+	}
+	fields := strings.Fields(subject)
+	if len(fields) == 0 {
+		return ""
+	}
+	word := strings.ToLower(strings.Trim(fields[0], ".,:;!"))
+	if inflectedCommitVerb(word) {
+		return fields[0]
+	}
+	return ""
+}
+
+// inflectedCommitVerb reports whether word is one of commitVerbs with a verb
+// ending, allowing for a doubled final consonant ("dropped", "skipping")
+func inflectedCommitVerb(word string) bool {
+	for _, e := range verbEndings {
+		base, ok := strings.CutSuffix(word, e.suffix)
+		if !ok || base == "" {
+			continue
+		}
+		if commitVerbs[base+e.replacement] {
+			return true
+		}
+		if n := len(base); e.replacement == "" && n > 1 && base[n-1] == base[n-2] && commitVerbs[base[:n-1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCommitType warns when the model used a type outside the allowed list
+func checkCommitType(message string) {
+	if problem := commitTypeProblem(message); problem != "" {
+		info("Warning: %s", problem)
+	}
+}
+
+// commitTypeProblem explains why the message's type isn't allowed, or
+// returns "" if it is
+func commitTypeProblem(message string) string {
+	t := commitType(message)
+	if t == "" {
+		return "The subject doesn't follow the conventional commit format"
+	}
+	for _, allowed := range commitTypes {
+		if t == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Type %q isn't one of the allowed types (%s)", t, strings.Join(commitTypes, ", "))
+}
+
+// applySubjectCase changes the case of the first letter of the subject's
+// description, leaving the type prefix untouched. Words that look like
+// acronyms or identifiers (e.g. "API", "README") are left alone when
+// lowercasing.
+func applySubjectCase(message, mode string) string {
+	if mode == "preserve" {
+		return message
+	}
+	subject, body, hasBody := strings.Cut(message, "\n")
+	prefix, description := "", subject
+	if m := subjectPattern.FindStringSubmatch(subject); m != nil {
+		prefix, description = m[1], m[3]
+	}
+
+	runes := []rune(description)
+	switch {
+	case len(runes) == 0:
+	case mode == "sentence":
+		runes[0] = unicode.ToUpper(runes[0])
+	case mode == "lower" && !(len(runes) > 1 && unicode.IsUpper(runes[1])):
+		runes[0] = unicode.ToLower(runes[0])
+	}
+
+	subject = prefix + string(runes)
+	if hasBody {
+		return subject + "\n" + body
+	}
+	return subject
+}
+
+// pipeMessage runs the message through a shell command and returns its
+// stdout, keeping the original message if the command fails
+func pipeMessage(command, message string) string {
+	debug("Piping message through %q", command)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(message)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		info("Warning: --pipe command failed (%v), keeping the original message", err)
+		return message
+	}
+	piped := strings.TrimSpace(string(output))
+	if piped == "" {
+		info("Warning: --pipe command produced no output, keeping the original message")
+		return message
+	}
+	return piped
+}
+
+// committerIdent returns the committer as "Name <email>"
+func committerIdent() (string, error) {
+	output, err := exec.Command("git", "var", "GIT_COMMITTER_IDENT").Output()
+	if err != nil {
+		return "", err
+	}
+	// Output is "Name <email> timestamp timezone"
+	ident := strings.TrimSpace(string(output))
+	if i := strings.LastIndex(ident, ">"); i >= 0 {
+		ident = ident[:i+1]
+	}
+	return ident, nil
+}
+
+// applyTrailers runs the message through git interpret-trailers so trailers
+// configured via trailer.* git config are applied, along with footers from the
+// config file and Signed-off-by when --signoff is set. The message is returned
+// unchanged if git fails.
+func applyTrailers(message string) string {
+	args := []string{"interpret-trailers"}
+
+	keys := make([]string, 0, len(cfg.Footers))
+	for key := range cfg.Footers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--if-exists", "addIfDifferent", "--trailer", key+": "+cfg.Footers[key])
+	}
+
+	for _, line := range renderFooterTemplate(message) {
+		// A Change-Id must stay the same across amends, so never replace one
+		ifExists := "addIfDifferent"
+		if strings.HasPrefix(line, "Change-Id:") {
+			ifExists = "doNothing"
+		}
+		args = append(args, "--if-exists", ifExists, "--trailer", line)
+	}
+
+	if signoff {
+		ident, err := committerIdent()
+		if err != nil {
+			info("Warning: Could not determine committer identity for Signed-off-by: %v", err)
+		} else {
+			args = append(args, "--if-exists", "addIfDifferent", "--trailer", "Signed-off-by: "+ident)
+		}
+	}
+
+	cmd := exec.Command("git", args...)
+	// Without a trailing newline git doesn't separate the trailers from the body
+	cmd.Stdin = strings.NewReader(message + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		debug("git interpret-trailers failed, keeping message as is: %v", err)
+		return message
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// dateLayouts are the named --date-format values, both ISO 8601
+var dateLayouts = map[string]string{
+	"date":     "2006-01-02",
+	"datetime": time.RFC3339,
+}
+
+// formatDate formats t for generated text with --date-format. It's in UTC so
+// trailers don't depend on where they were written, unless TZ asks for a
+// specific zone.
+func formatDate(t time.Time) string {
+	if os.Getenv("TZ") == "" {
+		t = t.UTC()
+	}
+	layout := dateFormat
+	if named, ok := dateLayouts[layout]; ok {
+		layout = named
+	}
+	return t.Format(layout)
+}
+
+// renderFooterTemplate fills in the placeholders of --footer-template (or
+// footer_template from the config file) and returns one trailer per line
+func renderFooterTemplate(message string) []string {
+	template := cfg.FooterTemplate
+	if footerTemplate != "" {
+		template = footerTemplate
+	}
+	if strings.TrimSpace(template) == "" {
+		return nil
+	}
+	// Let a one-line flag value carry several trailers
+	template = strings.ReplaceAll(template, `\n`, "\n")
+
+	branch, err := currentBranch()
+	if err != nil {
+		debug("Could not get branch for footer template: %v", err)
+	}
+	changeID := ""
+	if strings.Contains(template, "{change_id}") {
+		changeID = gerritChangeID(message)
+	}
+	replacer := strings.NewReplacer(
+		"{branch}", branch,
+		"{date}", formatDate(time.Now()),
+		"{change_id}", changeID,
+	)
+
+	var trailers []string
+	for _, line := range strings.Split(replacer.Replace(template), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			trailers = append(trailers, line)
+		}
+	}
+	return trailers
+}
+
+// gerritChangeID computes a Change-Id the same way Gerrit's commit-msg hook
+// does, from the staged tree, parent, identities and message
+func gerritChangeID(message string) string {
+	var input strings.Builder
+	if tree, err := exec.Command("git", "write-tree").Output(); err == nil {
+		fmt.Fprintf(&input, "tree %s\n", strings.TrimSpace(string(tree)))
+	}
+	if parent, err := exec.Command("git", "rev-parse", "HEAD").Output(); err == nil {
+		fmt.Fprintf(&input, "parent %s\n", strings.TrimSpace(string(parent)))
+	}
+	for _, ident := range []string{"GIT_AUTHOR_IDENT", "GIT_COMMITTER_IDENT"} {
+		if output, err := exec.Command("git", "var", ident).Output(); err == nil {
+			fmt.Fprintf(&input, "%s %s\n", strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(ident, "_IDENT"), "GIT_")), strings.TrimSpace(string(output)))
+		}
+	}
+	fmt.Fprintf(&input, "\n%s", message)
+	return fmt.Sprintf("I%x", sha1.Sum([]byte(input.String())))
+}
+
+// currentBranch returns the checked out branch name, or "HEAD" when detached
+func currentBranch() (string, error) {
+	output, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		// rev-parse fails before the first commit, but the branch still exists
+		// as a symbolic ref
+		output, err = exec.Command("git", "symbolic-ref", "--short", "HEAD").Output()
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+type binaryChange struct {
+	Path    string
+	OldSize int64
+	NewSize int64
+}
+
+// stagedBinaryChanges returns the staged binary files along with the number
+// of staged text files. Binary files are reported by numstat as "-\t-\tpath".
+func stagedBinaryChanges() ([]binaryChange, int, error) {
+	output, err := exec.Command("git", "diff", "--cached", "--numstat", "--no-renames").Output()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var binaries []binaryChange
+	textChanges := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] != "-" || fields[1] != "-" {
+			textChanges++
+			continue
+		}
+		binaries = append(binaries, binaryChange{
+			Path:    fields[2],
+			OldSize: blobSize("HEAD:" + fields[2]),
+			NewSize: blobSize(":" + fields[2]),
+		})
+	}
+	return binaries, textChanges, nil
+}
+
+// blobSize returns the size of the object at rev, or -1 if it doesn't exist
+func blobSize(rev string) int64 {
+	output, err := exec.Command("git", "cat-file", "-s", rev).Output()
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// largeFileNote describes the files left out by --summarize-large-files by
+// how many lines they add and remove, from git diff --numstat
+func largeFileNote(paths []string) string {
+	counts := make(map[string]string)
+	output, err := exec.Command("git", "diff", "--cached", "--numstat", "--no-renames").Output()
+	if err != nil {
+		debug("Could not count changed lines: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if fields := strings.SplitN(line, "\t", 3); len(fields) == 3 {
+			counts[fields[2]] = fmt.Sprintf("%s additions/%s deletions", fields[0], fields[1])
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("These files changed too, but their diffs are too large to include, so only the size of the change is given:")
+	for _, p := range paths {
+		count := counts[p]
+		if count == "" {
+			count = "size unknown"
+		}
+		fmt.Fprintf(&sb, "\n- large file %s changed: %s", p, count)
+	}
+	return sb.String()
+}
+
+func isBinaryChange(binaries []binaryChange, path string) bool {
+	for _, b := range binaries {
+		if b.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExtension reports whether path ends in one of exts, ignoring case.
+// Extensions may be given with or without the leading dot.
+func hasExtension(path string, exts []string) bool {
+	path = strings.ToLower(path)
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if strings.HasSuffix(path, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatSize formats a byte count for humans
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// preCommitSummary describes what is about to be committed, calling out binary
+// files so large assets aren't committed by accident
+func preCommitSummary(branch string, binaries []binaryChange) string {
+	summary := "Branch: " + branch
+	if len(binaries) == 0 {
+		return summary
+	}
+	summary += fmt.Sprintf("\nBinary files (%d):", len(binaries))
+	for _, b := range binaries {
+		switch {
+		case b.OldSize < 0:
+			summary += fmt.Sprintf("\n  + %s (new, %s)", b.Path, formatSize(b.NewSize))
+		case b.NewSize < 0:
+			summary += fmt.Sprintf("\n  - %s (deleted)", b.Path)
+		default:
+			summary += fmt.Sprintf("\n  ~ %s (%s)", b.Path, formatSize(b.NewSize))
+		}
+	}
+	return summary
+}
+
+func binarySummary(binaries []binaryChange) string {
+	var sb strings.Builder
+	sb.WriteString("Binary files changed (no textual diff is available for these):")
+	for _, b := range binaries {
+		sb.WriteString("\n- " + describeBinary(b))
+	}
+	return sb.String()
+}
+
+// describeBinary describes a binary change by its path and sizes
+func describeBinary(b binaryChange) string {
+	switch {
+	case b.OldSize < 0:
+		return fmt.Sprintf("%s (added, %d bytes)", b.Path, b.NewSize)
+	case b.NewSize < 0:
+		return fmt.Sprintf("%s (deleted, was %d bytes)", b.Path, b.OldSize)
+	}
+	return fmt.Sprintf("%s (%d -> %d bytes, %+d)", b.Path, b.OldSize, b.NewSize, b.NewSize-b.OldSize)
+}
+
+type modeChange struct {
+	Path     string
+	OldMode  string
+	NewMode  string
+	ModeOnly bool
+}
+
+// stagedModeChanges returns files whose mode changed (e.g. chmod +x), noting
+// which of them have no content changes at all
+func stagedModeChanges() ([]modeChange, error) {
+	output, err := exec.Command("git", "diff", "--cached", "--numstat", "--summary", "--no-renames").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	unchanged := map[string]bool{}
+	var changes []modeChange
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.SplitN(line, "\t", 3); len(fields) == 3 {
+			unchanged[fields[2]] = fields[0] == "0" && fields[1] == "0"
+			continue
+		}
+		// e.g. " mode change 100644 => 100755 script.sh"
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), "mode change ")
+		if !ok {
+			continue
+		}
+		fields := strings.SplitN(rest, " ", 4)
+		if len(fields) != 4 || fields[1] != "=>" {
+			continue
+		}
+		changes = append(changes, modeChange{Path: fields[3], OldMode: fields[0], NewMode: fields[2]})
+	}
+	for i := range changes {
+		changes[i].ModeOnly = unchanged[changes[i].Path]
+	}
+	return changes, nil
+}
+
+func modeSummary(changes []modeChange) string {
+	var sb strings.Builder
+	sb.WriteString("File mode changes (make sure the message mentions these):\n")
+	for _, c := range changes {
+		fmt.Fprintf(&sb, "- %s changed mode from %s to %s", c.Path, c.OldMode, c.NewMode)
+		if c.ModeOnly {
+			sb.WriteString(" (mode change only, content is unchanged)")
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+type rename struct {
+	From       string
+	To         string
+	Similarity int
+}
+
+// stagedRenames returns the renames git detects in the staged changes
+func stagedRenames() ([]rename, error) {
+	output, err := exec.Command("git", "diff", "--cached", "--name-status", "-M").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var renames []rename
+	for _, line := range strings.Split(string(output), "\n") {
+		// e.g. "R097\told/path.go\tnew/path.go"
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "R") {
+			continue
+		}
+		similarity, _ := strconv.Atoi(strings.TrimPrefix(fields[0], "R"))
+		renames = append(renames, rename{From: fields[1], To: fields[2], Similarity: similarity})
+	}
+	return renames, nil
+}
+
+func renameSummary(renames []rename) string {
+	var sb strings.Builder
+	sb.WriteString("Renamed files (the textual diff for these may be small or empty):\n")
+	for _, r := range renames {
+		fmt.Fprintf(&sb, "- renamed %s -> %s", r.From, r.To)
+		if r.Similarity < 100 {
+			fmt.Fprintf(&sb, " (%d%% similar)", r.Similarity)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// squashMessage generates one message covering every commit in revRange, for
+// use when squashing them together
+func squashMessage(p Provider, providerName, model, revRange string) (string, error) {
+	debug("Getting commits in %s...", revRange)
+	commits, err := exec.Command("git", "log", "--pretty=format:%B", revRange).Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting commits in %s: %w", revRange, err)
+	}
+	if len(bytes.TrimSpace(commits)) == 0 {
+		return "", fmt.Errorf("no commits found in %s", revRange)
+	}
+
+	debug("Getting diff for %s...", revRange)
+	diff, err := exec.Command("git", "diff", revRange).Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting diff for %s: %w", revRange, err)
+	}
+	promptDiff, notes := preparePromptDiff(string(diff), rangeSanitizer(revRange))
+	notes = append([]string{
+		"The recent commits above are being squashed into a single commit along with the diff. Write ONE cohesive message that covers all of them, not a list of the individual commits.",
+	}, notes...)
+
+	prompt := buildPrompt(string(commits), promptDiff, notes)
+	if err := checkMessagePrompt(providerName, model, prompt); err != nil {
+		return "", err
+	}
+	return generateMessage(p, model, prompt)
+}
+
+// diffFileMessage generates a message for a saved diff or patch (or stdin
+// for "-") instead of the staged changes. It doesn't need a repository, so
+// git is only used for optional extras like the style reference.
+func diffFileMessage(p Provider, providerName, model, path string) (string, error) {
+	var diff []byte
+	var err error
+	if path == "-" {
+		diff, err = io.ReadAll(os.Stdin)
+	} else {
+		diff, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading diff: %w", err)
+	}
+	if len(bytes.TrimSpace(diff)) == 0 {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+
+	recentCommits, err := recentCommitMessages()
+	if err != nil {
+		debug("Skipping recent commits, git log failed: %v", err)
+		recentCommits = nil
+	}
+
+	// A saved diff has nothing to read the files from, so only regions with
+	// their markers in the diff are found
+	promptDiff, notes := preparePromptDiff(string(diff), &diffSanitizer{})
+	if len(userContext) > 0 {
+		notes = append(notes, contextNote(userContext))
+	}
+
+	prompt := buildPrompt(string(recentCommits), promptDiff, notes)
+	if err := checkMessagePrompt(providerName, model, prompt); err != nil {
+		return "", err
+	}
+	msg, err := generateMessage(p, model, prompt)
+	if err != nil {
+		return "", err
+	}
+	return postProcess(msg), nil
+}
+
+// buildEmptyCommitPrompt asks for a message for an --allow-empty commit, which
+// has no diff, so the intent comes from the user's note or the branch name
+func buildEmptyCommitPrompt(recentCommits, branch string, intents []string) string {
+	intent := "The user didn't describe the intent, so assume it's to trigger CI unless the branch name suggests otherwise."
+	if len(intents) > 0 {
+		intent = "The user describes the intent as: " + strings.Join(intents, "; ")
+	}
+	return fmt.Sprintf(`Generate a git commit message for an EMPTY commit (no file changes).
+Use conventional commit format (type: concise description), usually with the chore or ci type.
+Keep it minimal, e.g. "chore: trigger CI" or "ci: rerun flaky integration tests".
+Return a single line only - no body, no introduction, no explanation, no quotes around it.
+
+%s
+Current branch: %s
+
+Recent commits from this repo (for style reference):
+%s`, intent, branch, recentCommits)
+}
+
+// publicDeclPattern matches declarations that are usually part of a public
+// API: exported Go functions and methods, JS/TS exports, Rust pub fns and
+// Python functions without a leading underscore
+var publicDeclPattern = regexp.MustCompile(`^\s*(?:func\s+(?:\([^)]*\)\s*)?([A-Z]\w*)\s*[(\[]|export\s+(?:default\s+)?(?:async\s+)?function\*?\s+(\w+)|pub\s+(?:async\s+)?fn\s+(\w+)|def\s+([A-Za-z]\w*)\s*\()`)
+
+func publicDeclName(line string) string {
+	m := publicDeclPattern.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	for _, name := range m[1:] {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// diffPath returns the new path of a file chunk from splitDiff
+func diffPath(fileDiff string) string {
+	header, _, _ := strings.Cut(fileDiff, "\n")
+	if i := strings.LastIndex(header, " b/"); i >= 0 {
+		return header[i+3:]
+	}
+	return ""
+}
+
+// detectBreakingChanges looks for public declarations that were removed or
+// had their signature changed. It's a heuristic, so it only makes suggestions.
+func detectBreakingChanges(diff string) []string {
+	var reasons []string
+	for _, file := range splitDiff(diff) {
+		removed := map[string]string{}
+		added := map[string]string{}
+		for _, line := range strings.Split(file, "\n") {
+			switch {
+			case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+			case strings.HasPrefix(line, "-"):
+				if name := publicDeclName(line[1:]); name != "" {
+					removed[name] = strings.TrimSpace(line[1:])
+				}
+			case strings.HasPrefix(line, "+"):
+				if name := publicDeclName(line[1:]); name != "" {
+					added[name] = strings.TrimSpace(line[1:])
+				}
+			}
+		}
+
+		path := diffPath(file)
+		for name, oldDecl := range removed {
+			newDecl, ok := added[name]
+			switch {
+			case !ok:
+				reasons = append(reasons, fmt.Sprintf("removed %s in %s", name, path))
+			case newDecl != oldDecl:
+				reasons = append(reasons, fmt.Sprintf("changed signature of %s in %s", name, path))
+			}
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+func breakingNote(reasons []string) string {
+	note := "This change is BREAKING. Add a ! after the type (e.g. feat!: ...) and end the message with a footer line \"BREAKING CHANGE: <short description of what breaks>\"."
+	if len(reasons) > 0 {
+		note += "\nLikely breaking changes:\n- " + strings.Join(reasons, "\n- ")
+	}
+	return note
+}
+
+// contextNote presents the user's --context values, which explain intent the
+// diff can't show
+func contextNote(context []string) string {
+	return "Context from the author about why this change was made (use it to explain the change, but the diff is the source of truth for what changed):\n- " + strings.Join(context, "\n- ")
+}
+
+// branchNote describes the branch name, which often hints at the intent
+func branchNote(branch string) string {
+	return fmt.Sprintf("The current branch is %q. Its name may hint at the intent of the change (e.g. fix/login-timeout), but ignore it if it looks unrelated to the diff.", branch)
+}
+
+// maxContextCmdOutput caps how much --context-cmd output goes into the prompt
+const maxContextCmdOutput = 4000
+
+// contextCmdNote runs the --context-cmd command and presents its output,
+// e.g. test results. A failing command is reported along with its output,
+// since that's usually the interesting part.
+func contextCmdNote(command string) (string, error) {
+	debug("Running context command %q", command)
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	status := "succeeded"
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = fmt.Sprintf("failed with exit status %d", exitErr.ExitCode())
+	} else if err != nil {
+		return "", err
+	}
+
+	// Summaries usually come last, so keep the end of long output
+	text := strings.TrimSpace(string(bytes.ToValidUTF8(output, []byte("\uFFFD"))))
+	if len(text) > maxContextCmdOutput {
+		text = "[... earlier output truncated ...]\n" + text[len(text)-maxContextCmdOutput:]
+	}
+	return fmt.Sprintf("Output of the command `%s`, which %s. Mention the verification state (e.g. tests passing) only if it's relevant:\n%s", command, status, text), nil
+}
+
+// recentCommitMessages returns the last few commit messages, which the
+// model uses for style reference. With --style-from mine only the current
+// user's commits are used, since mixed-author repos have mixed styles, and
+// with --style-from history the messages they accepted or edited before.
+func recentCommitMessages() ([]byte, error) {
+	if styleFrom == "history" {
+		messages, err := acceptedMessages(maxHistorySamples)
+		if err == nil && len(messages) > 0 {
+			return []byte(strings.Join(messages, "\n\n")), nil
+		}
+		debug("No accepted messages in history (%v), using recent commits", err)
+	}
+	args := []string{"log", "-3", "--pretty=format:%B"}
+	if styleFrom == "mine" {
+		if email := gitConfig("user.email"); email != "" {
+			args = append(args, "--fixed-strings", "--author="+email)
+		} else {
+			info("Warning: user.email isn't set, so --style-from mine uses commits from all authors")
+		}
+	}
+	return exec.Command("git", args...).Output()
+}
+
+// stagedWordDiff returns the staged changes as a word diff, which reads
+// better than a line diff for prose. It returns "" when there are no word
+// level changes to show (e.g. only binary or mode changes), in which case the
+// normal diff should be used. Its lines can't be mapped onto commit:ignore
+// regions, so it isn't used when the staged files have any.
+func stagedWordDiff() string {
+	output, err := exec.Command("git", "diff", "--cached", "--word-diff").Output()
+	if err != nil {
+		debug("git diff --word-diff failed: %v", err)
+		return ""
+	}
+	words := sanitizeDiff(string(output), &diffSanitizer{})
+	if !strings.Contains(words, "[-") && !strings.Contains(words, "{+") {
+		return ""
+	}
+	return words
+}
+
+// repoRoot returns the top level directory of the working tree
+func repoRoot() (string, error) {
+	output, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// contextFiles returns the .commitcontext files in the current directory and
+// the repo root, without duplicates
+func contextFiles() []string {
+	dirs := []string{"."}
+	if root, err := repoRoot(); err == nil {
+		dirs = append(dirs, root)
+	}
+
+	var files []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		path, err := filepath.Abs(filepath.Join(dir, ".commitcontext"))
+		if err != nil || seen[path] {
+			continue
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+func contextFileNote(content string) string {
+	return fmt.Sprintf(`Project notes from .commitcontext (background on the codebase and its conventions, not part of the change):
+--- BEGIN .commitcontext ---
+%s
+--- END .commitcontext ---`, strings.TrimSpace(content))
+}
+
+// estimateTokens roughly estimates the number of tokens in text, assuming
+// about four characters per token
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// checkPromptSize asks before sending a prompt of more than
+// --max-input-tokens, returning errAborted if the user declines
+func checkPromptSize(tokens int) error {
+	debug("Estimated prompt size: %d tokens", tokens)
+	if maxInputTokens > 0 && tokens > maxInputTokens {
+		info("Warning: The prompt is about %d tokens, above the %d token threshold (--max-input-tokens)", tokens, maxInputTokens)
+		if !autoAccept && !confirm("Send it anyway? [y/N] ") {
+			info("Aborted without calling the API.")
+			return errAborted
+		}
+	}
+	return nil
+}
+
+// checkPrompt prints the --estimate and asks before sending a prompt above
+// --max-input-tokens or --cost-warn, with room for outputTokens in the reply
+func checkPrompt(provider, model, prompt string, outputTokens int) error {
+	tokens := estimateTokens(prompt)
+	if err := checkPromptSize(tokens); err != nil {
+		return err
+	}
+	return checkCost(provider, model, tokens, outputTokens)
+}
+
+// checkMessagePrompt is checkPrompt for a prompt sent with generateMessage
+func checkMessagePrompt(provider, model, prompt string) error {
+	tokens := estimateTokens(prompt)
+	if err := checkPromptSize(tokens); err != nil {
+		return err
+	}
+	return checkMessageCost(provider, model, tokens)
+}
+
+// preparePromptDiff gets a diff ready for a prompt: commit:ignore regions are
+// left out with s (nil when the diff was already sanitized), long files are
+// cut to --max-file-lines, the least important files (tests, generated code)
+// are dropped to fit --max-diff-bytes and --anonymize is applied. The notes
+// tell the model which files were dropped.
+func preparePromptDiff(diff string, s *diffSanitizer) (string, []string) {
+	if s != nil {
+		diff = sanitizeDiff(diff, s)
+	}
+	diff, omitted := prioritizeDiff(truncateFileLines(diff, maxFileLines), maxDiffBytes)
+	var notes []string
+	if len(omitted) > 0 {
+		debug("Diff exceeds %d bytes, left out: %v", maxDiffBytes, omitted)
+		notes = append(notes, "These files also changed, but their diffs were left out to save space:\n- "+strings.Join(omitted, "\n- "))
+	}
+	if anonymizeMode {
+		diff = anonymizeDiff(diff)
+	}
+	return diff, notes
+}
+
+// splitDiff splits a unified diff into one chunk per file
+func splitDiff(diff string) []string {
+	var files []string
+	for _, chunk := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(chunk, "diff --git ") || len(files) == 0 {
+			files = append(files, "")
+		}
+		files[len(files)-1] += chunk
+	}
+	return files
+}
+
+// summarizeDiff asks the model for a one-line summary of each file in the
+// diff, batching files so that no single request exceeds batchSize bytes
+func summarizeDiff(p Provider, model, diff string, batchSize int) (string, error) {
+	var batches []string
+	current := ""
+	for _, file := range splitDiff(diff) {
+		if len(file) > batchSize {
+			file = file[:batchSize] + "\n... (truncated)\n"
+		}
+		if current != "" && len(current)+len(file) > batchSize {
+			batches = append(batches, current)
+			current = ""
+		}
+		current += file
+	}
+	if current != "" {
+		batches = append(batches, current)
+	}
+
+	var summaries []string
+	for i, batch := range batches {
+		debug("Summarizing diff batch %d/%d (%d bytes)", i+1, len(batches), len(batch))
+		summary, err := complete(p, model, `Summarize the following git diff one file at a time.
+For each file write a single line in the form "path: what changed". Be terse and specific.
+Return ONLY the summary lines - no introduction, no explanation.
+
+`+batch, 1000)
+		if err != nil {
+			return "", err
+		}
+		summaries = append(summaries, summary)
+	}
+	return strings.Join(summaries, "\n"), nil
+}
+
+// defaultExamples are the example messages in the prompt, unless the config
+// file's examples or examples_file replace them
+const defaultExamples = `feat: add user auth system
+
+- Add JWT tokens for API auth
+- Handle token refresh for long sessions
+
+fix: resolve memory leak in worker pool
+
+- Clean up idle connections
+- Add timeout for stale workers
+
+Simple change example:
+fix: typo in README.md`
+
+func buildPrompt(recentCommits, diff string, notes []string) string {
+	// A brand new repo has no history to take style cues from
+	style := "Very important: Do not respond with any of the examples. Your message must be based off the diff that is about to be provided."
+	if strings.TrimSpace(recentCommits) != "" {
+		style = fmt.Sprintf(`Very important: Do not respond with any of the examples. Your message must be based off the diff that is about to be provided, with a little bit of styling informed by the recent commits you're about to see.
+
+Recent commits from this repo (for style reference):
+%s`, recentCommits)
+	}
+
+	examples := defaultExamples
+	if len(promptExamples) > 0 {
+		examples = strings.Join(promptExamples, "\n\n")
+	}
+
+	prompt := fmt.Sprintf(`Generate a git commit message following this structure:
+1. First line: conventional commit format (type: concise description) (the type must be one of: %s)
+2. Optional bullet points if more context helps:
+   - Keep the second line blank
+   - Keep them short and direct
+   - Focus on what changed
+   - Always be terse
+   - Don't overly explain
+   - Drop any fluffy or formal language
+
+Return ONLY the commit message - no introduction, no explanation, no quotes around it.
 
-func debug(format string, a ...interface{}) {
-	if debugMode {
-		fmt.Fprintf(os.Stderr, "DEBUG: "+format+"\n", a...)
+Examples:
+%s
+
+%s
+
+Here's the current diff. Your commit message should be based off this diff:
+
+%s`, strings.Join(commitTypes, ", "), examples, style, diff)
+
+	for _, note := range notes {
+		prompt += "\n\n" + note
 	}
+	return prompt
 }
 
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
+func main() {
+	flag.BoolVar(&debugMode, "debug", false, "Enable debug output")
+	flag.StringVar(&expectBranch, "expect-branch", "", "Refuse to commit unless the current branch matches this name")
+	flag.StringVar(&modelFlag, "model", "", "Model to use (overrides COMMIT_AI_MODEL and git config commit-ai.model)")
+	flag.StringVar(&providerFlag, "provider", "", "Provider to use (overrides COMMIT_AI_PROVIDER and git config commit-ai.provider)")
+	flag.BoolVar(&summarizeLongDiff, "summarize-long-diff", false, "Summarize large diffs per file before generating the message")
+	flag.IntVar(&summarizeThreshold, "summarize-threshold", 50000, "Diff size in bytes above which --summarize-long-diff kicks in")
+	flag.BoolVar(&minimalMode, "minimal", false, "Send only the diff stat instead of the full diff (cheaper, less precise)")
+	flag.StringVar(&squashRange, "squash", "", "Print a single message summarizing the commits in this revision range (e.g. main..HEAD) instead of committing")
+	flag.BoolVar(&thinkingMode, "thinking", false, "Enable extended thinking (supported models only, uses more tokens)")
+	flag.IntVar(&thinkingBudget, "thinking-budget", 2048, "Token budget for extended thinking (minimum 1024)")
+	flag.BoolVar(&signoff, "signoff", false, "Add a Signed-off-by trailer using the committer identity")
+	flag.BoolVar(&signoff, "s", false, "Shorthand for --signoff")
+	flag.BoolVar(&allowEmpty, "allow-empty", false, "Allow committing with no staged changes (passed through to git commit)")
+	flag.StringVar(&emptyNote, "note", "", "Describe the intent of an --allow-empty commit for the message")
+	flag.StringVar(&outputFile, "output", "", "Also write the final message to this file")
+	flag.BoolVar(&dryRun, "dry-run", false, "Generate the message without committing (printed to stdout, or written to --output)")
+	flag.StringVar(&pipeCommand, "pipe", "", "Shell command to pipe the generated message through (its stdout becomes the message)")
+	flag.BoolVar(&breakingChange, "breaking", false, "Mark the commit as a breaking change (type! and a BREAKING CHANGE footer)")
+	flag.BoolVar(&changelogMode, "changelog", false, "Print a markdown changelog of the commits since the last tag instead of committing")
+	flag.StringVar(&subjectCase, "subject-case", "preserve", "Case of the subject description: lower, sentence or preserve")
+	flag.Var(&userContext, "context", "Explain the reason for the change to the model (can be repeated)")
+	flag.BoolVar(&autoAccept, "yes", false, "Accept the generated message and commit without prompting")
+	flag.BoolVar(&autoAccept, "y", false, "Shorthand for --yes")
+	flag.BoolVar(&quietMode, "quiet", false, "Suppress all non-error output on stderr")
+	flag.IntVar(&maxInputTokens, "max-input-tokens", 30000, "Ask for confirmation before sending prompts estimated above this many tokens (0 disables)")
+	flag.StringVar(&typesFlag, "types", "", "Comma-separated list of allowed conventional commit types (e.g. feat,fix,wip,hotfix)")
+	flag.BoolVar(&refineMode, "refine", false, "Have the model critique and improve its first message (uses a second API call)")
+	flag.BoolVar(&noNewFileContent, "no-new-file-content", false, "Don't add the full contents of new files to the prompt (the staged diff already includes them)")
+	flag.BoolVar(&checkSetup, "check", false, "Verify the API key, provider and model with a minimal request, then exit")
+	flag.IntVar(&maxDiffBytes, "max-diff-bytes", 100000, "Leave out the least important files once the diff exceeds this many bytes (0 disables)")
+	flag.StringVar(&hookFile, "hook", "", "Run as a prepare-commit-msg hook: write the message into this file (git's $1) instead of committing")
+	flag.IntVar(&maxFileLines, "max-file-lines", 0, "Truncate each file's diff to this many lines in the prompt (0 disables)")
+	flag.BoolVar(&noHistory, "no-history", false, "Don't record generated messages in ~/.local/state/commit/history.jsonl")
+	flag.BoolVar(&autoSplit, "auto-split", false, "Let the model group the staged hunks into several well-scoped commits")
+	flag.StringVar(&footerTemplate, "footer-template", "", "Trailers to add to every message, one per line; supports {branch}, {date} and {change_id}")
+	flag.StringVar(&providersFlag, "providers", "", "Comma-separated providers to try in order, falling back when one fails (e.g. anthropic,openai,ollama)")
+	flag.BoolVar(&useBranchContext, "use-branch-context", false, "Include the current branch name in the prompt (skipped on a detached HEAD)")
+	flag.BoolVar(&useCache, "cache", false, "Reuse the message generated for the same prompt within --cache-ttl instead of calling the API again")
+	flag.DurationVar(&cacheTTL, "cache-ttl", time.Hour, "How long --cache keeps generated messages")
+	flag.Var(&stopFlag, "stop", "Stop sequence that ends the model's reply (can be repeated, replaces the defaults; --stop= disables them)")
+	flag.BoolVar(&anonymizeMode, "anonymize", false, "Replace identifiers and string literals in the diff with placeholders before sending it (less precise messages)")
+	flag.StringVar(&subjectPrefix, "prefix", "", "Text to put before the subject line (e.g. \"[WIP] \")")
+	flag.StringVar(&subjectSuffix, "suffix", "", "Text to put after the subject line (e.g. \" (#123)\")")
+	flag.StringVar(&contextCmd, "context-cmd", "", "Shell command whose output (e.g. test results) is included in the prompt")
+	flag.StringVar(&defaultAction, "default-action", "", "Action taken when pressing Enter at the prompt: accept, edit or reject (default none)")
+	flag.BoolVar(&selectMode, "select", false, "Choose which staged files' diffs are sent to the model (they're still committed)")
+	flag.Var(&apiKeys, "api-key", "API key to use instead of the environment variable (can be repeated to fail over when one is rate limited)")
+	flag.IntVar(&minDiffBytes, "min-diff-bytes", 0, "Use a local \"chore: minor edits\" message without calling the API when fewer bytes than this changed (0 disables)")
+	flag.IntVar(&minDiffBytes, "local-threshold", 0, "Same as --min-diff-bytes")
+	flag.IntVar(&maxBodyLines, "max-body-lines", 0, "Keep at most this many lines in the message body (0 disables)")
+	flag.StringVar(&styleFrom, "style-from", "all", "Whose recent commits are used as style reference: all, mine (matching git config user.email) or history (messages you accepted or edited before)")
+	flag.StringVar(&diffFile, "diff-file", "", "Print a message for the diff or patch in this file (- for stdin) instead of the staged changes")
+	flag.StringVar(&commitArgs, "commit-args", "", "Extra arguments passed through to git commit, quoted like in a shell (e.g. \"--no-verify --author='A <a@b.c>'\")")
+	flag.BoolVar(&wordDiff, "word-diff", false, "Send a word diff instead of a line diff, which describes prose and docs changes better")
+	flag.BoolVar(&enforceTypes, "enforce-types", false, "Regenerate once, then fail, if the message doesn't use one of the allowed types")
+	flag.BoolVar(&appendMode, "append", false, "With --hook, refine or add to the message git already put in the file (from -m, a template or a merge) instead of replacing it")
+	flag.StringVar(&skipContentExt, "skip-content-ext", "", "Comma-separated extensions (e.g. .lock,.svg,.min.js) of new files whose content is left out of the prompt, keeping only their names")
+	flag.BoolVar(&emojiMode, "emoji", false, "Start the subject with the gitmoji for its type (e.g. \"✨ feat: ...\"), customizable with emoji_map in the config file")
+	flag.BoolVar(&summarizeLarge, "summarize-large-files", false, "Replace the diff of each file larger than --large-file-bytes with a count of its added and removed lines")
+	flag.IntVar(&largeFileBytes, "large-file-bytes", 20000, "Diff size in bytes above which --summarize-large-files summarizes a file")
+	flag.StringVar(&anthropicVersion, "anthropic-version", "", "anthropic-version header to send, to opt into newer API behavior (overrides COMMIT_AI_ANTHROPIC_VERSION and git config commit-ai.anthropic-version, default "+defaultAnthropicVersion+")")
+	flag.BoolVar(&estimateMode, "estimate", false, "Print the estimated token count and cost of the request before sending it")
+	flag.Float64Var(&costWarn, "cost-warn", 0, "Ask for confirmation before sending a request estimated to cost more than this many US dollars (0 disables)")
+	flag.BoolVar(&pushMode, "push", false, "Run git push after committing (asks first unless --yes)")
+	flag.BoolVar(&gitVerbose, "git-verbose", false, "Show git commit's output (e.g. from pre-commit hooks) as it runs")
+	flag.StringVar(&dateFormat, "date-format", "date", "Format of {date} in --footer-template: date (2006-01-02), datetime (RFC 3339) or a Go time layout. Dates are in UTC unless TZ is set")
+	flag.StringVar(&profile, "profile", "", "Use the settings of this profile from the config file's profiles")
+	flag.BoolVar(&imperativeMode, "imperative", false, "Insist on an imperative subject (\"add\", not \"added\" or \"adds\") and regenerate once if it isn't")
+	flag.BoolVar(&rejectGeneric, "reject-generic", false, "Offer to regenerate messages whose subject is a generic phrase like \"update files\" or \"fix bug\"")
+	flag.BoolVar(&listProvidersFlag, "list-providers", false, "List the supported providers, the environment variable each needs and whether it's set, then exit")
+	flag.StringVar(&fixedSubject, "subject", "", "Use this subject line and only have the model write the body")
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	parseFlags(flag.CommandLine, os.Args[1:])
 
-type AnthropicRequest struct {
-	Model     string    `json:"model"`
-	MaxTokens int       `json:"max_tokens"`
-	Messages  []Message `json:"messages"`
-}
+	if appendMode && hookFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: --append only works with --hook")
+		os.Exit(exitUsage)
+	}
 
-type AnthropicResponse struct {
-	Content []struct {
-		Text string `json:"text"`
-	} `json:"content"`
-}
+	// In hook mode git is already committing, so just write the message file
+	if hookFile != "" {
+		if os.Getenv(runningEnv) != "" {
+			debug("The commit was started by commit, keeping its message")
+			os.Exit(exitOK)
+		}
+		outputFile = hookFile
+		dryRun = true
+	}
 
-func getInput(prompt string) string {
-	fmt.Fprint(os.Stderr, prompt)
-	var input string
-	_, _ = fmt.Scanln(&input)
-	return strings.ToLower(strings.TrimSpace(input))
-}
+	if pushMode && dryRun {
+		fmt.Fprintln(os.Stderr, "Error: --push can't be used with --dry-run or --hook")
+		os.Exit(exitUsage)
+	}
 
-func editMessage(initial string) (string, error) {
-	// Create temporary file
-	tmpfile, err := os.CreateTemp("", "commit-msg-*.txt")
+	var err error
+	cfg, err = loadConfig()
 	if err != nil {
-		return "", err
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(exitError)
+	}
+	// An explicitly chosen profile's provider and model rank just below flags,
+	// above the environment and git config
+	var profileCfg Config
+	baseCfg := cfg
+	if profile != "" {
+		cfg, profileCfg, err = applyProfile(cfg, profile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		debug("Using profile %s", profile)
+		if providerFlag == "" {
+			providerFlag = profileCfg.Provider
+		}
+	}
+	promptExamples, err = loadExamples(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(exitError)
 	}
-	defer os.Remove(tmpfile.Name())
 
-	// Write initial message to file
-	if _, err := tmpfile.WriteString(initial); err != nil {
-		return "", err
+	extraCommitArgs, err = splitArgs(commitArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: Invalid --commit-args:", err)
+		os.Exit(exitUsage)
 	}
-	tmpfile.Close()
 
-	// Open editor
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = "vim" // fallback to vim
+	if cfg.EnforceTypes {
+		enforceTypes = true
 	}
-	cmd := exec.Command(editor, tmpfile.Name())
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return "", err
+	if cfg.RejectGeneric {
+		rejectGeneric = true
+	}
+	if cfg.Imperative {
+		imperativeMode = true
 	}
 
-	// Read edited message
-	content, err := os.ReadFile(tmpfile.Name())
-	if err != nil {
-		return "", err
+	// The config's emoji_map adds to and overrides the default gitmoji, and
+	// an empty emoji turns one off
+	emojiMap = make(map[string]string)
+	for t, emoji := range defaultEmojiMap {
+		emojiMap[t] = emoji
+	}
+	for t, emoji := range cfg.EmojiMap {
+		emojiMap[t] = emoji
 	}
-	return string(content), nil
-}
 
-func commitChanges(message string) error {
-	debug("Running git commit")
-	commitCmd := exec.Command("git", "commit", "-m", message)
-	if err := commitCmd.Run(); err != nil {
-		return fmt.Errorf("error running git commit: %w", err)
+	anthropicVersion = strings.TrimSpace(resolveSetting(anthropicVersion, "COMMIT_AI_ANTHROPIC_VERSION", "commit-ai.anthropic-version", defaultAnthropicVersion))
+	if anthropicVersion == "" || strings.ContainsAny(anthropicVersion, " \t\r\n") {
+		fmt.Fprintf(os.Stderr, "Error: Invalid --anthropic-version %q, expected a version like %s\n", anthropicVersion, defaultAnthropicVersion)
+		os.Exit(exitUsage)
 	}
 
-	return nil
-}
+	if styleFrom != "all" && styleFrom != "mine" && styleFrom != "history" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid --style-from %q, expected all, mine or history\n", styleFrom)
+		os.Exit(exitUsage)
+	}
 
-func main() {
-	// Remove dry-run flag, keep debug only
-	flag.BoolVar(&debugMode, "debug", false, "Enable debug output")
-	flag.Parse()
+	if defaultAction == "" {
+		defaultAction = cfg.DefaultAction
+	}
+	if defaultAction != "" && defaultAction != "accept" && defaultAction != "edit" && defaultAction != "reject" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid default action %q, expected accept, edit or reject\n", defaultAction)
+		os.Exit(exitUsage)
+	}
+
+	stopSequences = defaultStopSequences
+	if len(stopFlag) > 0 {
+		stopSequences = nil
+		for _, stop := range stopFlag {
+			if stop != "" {
+				stopSequences = append(stopSequences, stop)
+			}
+		}
+	}
+
+	commitTypes = defaultCommitTypes
+	if len(cfg.Types) > 0 {
+		commitTypes = cfg.Types
+	}
+	if typesFlag != "" {
+		commitTypes = splitList(typesFlag)
+	}
+	debug("Commit types: %v", commitTypes)
+
+	if subjectCase != "lower" && subjectCase != "sentence" && subjectCase != "preserve" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid --subject-case %q, expected lower, sentence or preserve\n", subjectCase)
+		os.Exit(exitUsage)
+	}
+	if thinkingMode && thinkingBudget < 1024 {
+		fmt.Fprintln(os.Stderr, "Error: --thinking-budget must be at least 1024")
+		os.Exit(exitUsage)
+	}
+
+	if listProvidersFlag {
+		if err := listProviders(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	// update doesn't talk to a model, so it doesn't need an API key
+	if flag.Arg(0) == "update" {
+		if err := runUpdate(flag.Args()[1:]); err == errAborted {
+			os.Exit(exitAborted)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		return
+	}
+
+	// Everything else shells out to git, which fails confusingly when git is
+	// missing or we're outside a repo. --check only tests the API.
+	if _, err := exec.LookPath("git"); err != nil && diffFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: git not found on PATH. Install git or add it to your PATH.")
+		os.Exit(exitGitNotFound)
+	}
+	if !checkSetup && diffFile == "" {
+		if output, err := exec.Command("git", "rev-parse", "--is-inside-work-tree").Output(); err != nil || strings.TrimSpace(string(output)) != "true" {
+			fmt.Fprintln(os.Stderr, "Error: Not inside a git working tree. Run commit from within a git repository.")
+			os.Exit(exitError)
+		}
+	}
+
+	// Without an explicit provider, use whichever one has an API key set
+	var selected providerInfo
+	var provider Provider
+	if providersFlag != "" {
+		chain, err := newFallbackProvider(splitList(providersFlag))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		selected, provider = chain.chain[0], chain
+		debug("Provider chain: %v", providersFlag)
+	} else {
+		providerName := resolveSetting(providerFlag, "COMMIT_AI_PROVIDER", "commit-ai.provider", cfg.Provider)
+		if providerName == "" && len(apiKeys) > 0 {
+			// A key given with --api-key is for the default provider
+			selected = providers[0]
+		} else if providerName == "" {
+			detected, ok := detectProvider()
+			if !ok {
+				fmt.Fprintln(os.Stderr, "Error: No API key found. Set ANTHROPIC_API_KEY or OPENAI_API_KEY")
+				os.Exit(exitError)
+			}
+			selected = detected
+			debug("Auto-detected provider %s from %s", selected.Name, selected.EnvVar)
+		} else {
+			found, ok := lookupProvider(providerName)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: Unsupported provider %q (supported: %s)\n", providerName, strings.Join(providerNames(), ", "))
+				os.Exit(exitUsage)
+			}
+			selected = found
+		}
+
+		var err error
+		provider, err = newProvider(selected, strings.Join(apiKeys, ","))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+	}
+	model := resolveModel(selected, profileCfg, baseCfg)
+	debug("Provider: %s, model: %s", selected.Name, model)
+
+	if checkSetup {
+		// Each provider in a --providers chain is checked on its own, otherwise a
+		// fallback answering would hide that the first one is broken
+		chain := []providerInfo{selected}
+		impls := []Provider{provider}
+		if f, ok := provider.(*fallbackProvider); ok {
+			chain, impls = f.chain, f.impls
+		}
+		failed := false
+		for i, p := range chain {
+			m := model
+			if i > 0 {
+				m = p.DefaultModel
+			}
+			if err := checkProvider(impls[i], m); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s check failed with model %s: %v\n", p.Name, m, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "OK: %s is reachable and model %s responded.\n", p.Name, m)
+		}
+		if failed {
+			os.Exit(exitAPIError)
+		}
+		return
+	}
+
+	// Subcommands come after any global flags, e.g. "commit --model x pr"
+	switch flag.Arg(0) {
+	case "pr":
+		if err := runPR(provider, selected.Name, model, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		return
+	case "type":
+		if err := runType(provider, selected.Name, model, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		return
+	case "bench":
+		if err := runBench(provider, selected.Name, model, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		return
+	case "":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown command %q\n", flag.Arg(0))
+		os.Exit(exitUsage)
+	}
+
+	if changelogMode {
+		log, err := changelog(provider, selected.Name, model)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		fmt.Println(log)
+		return
+	}
+
+	if squashRange != "" {
+		msg, err := squashMessage(provider, selected.Name, model, squashRange)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		fmt.Println(msg)
+		return
+	}
+
+	if diffFile != "" {
+		msg, err := diffFileMessage(provider, selected.Name, model, diffFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		fmt.Println(msg)
+		return
+	}
+
+	// Make sure we're on the branch the user expects before doing any work
+	branch, err := currentBranch()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting current branch:", err)
+		os.Exit(exitError)
+	}
+	debug("Current branch: %s", branch)
+	if expectBranch != "" && branch != expectBranch {
+		fmt.Fprintf(os.Stderr, "Error: On branch %s, expected %s. Refusing to commit.\n", branch, expectBranch)
+		os.Exit(exitError)
+	}
+
+	// Committing in the middle of a rebase or merge means something different
+	// than a plain commit, so don't do it silently. A prepare-commit-msg hook
+	// is already part of git's own commit, so it's left alone.
+	operation := inProgressOperation()
+	debug("Operation in progress: %q", operation)
+	switch {
+	case hookFile != "":
+	case operation == "rebase":
+		rebaseMessageFile = rebaseMessagePath()
+		if rebaseMessageFile == "" {
+			fmt.Fprintln(os.Stderr, "Error: A rebase is in progress. Finish it with git rebase --continue before using commit.")
+			os.Exit(exitError)
+		}
+		info("Warning: A rebase is in progress. The message will be saved for git rebase --continue instead of committing.")
+	case operation != "":
+		info("Warning: A %s is in progress. Committing will conclude it.", operation)
+	case branch == "HEAD":
+		info("Warning: You are in a detached HEAD state. The commit won't be on any branch.")
+	}
 
-	// Check for API key
-	apiKey := os.Getenv("ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		fmt.Fprintln(os.Stderr, "Error: ANTHROPIC_API_KEY environment variable is not set")
-		os.Exit(1)
+	// Without a terminal the prompt can't be answered, so fail before paying
+	// for a message
+	if !autoAccept && !dryRun && !isInteractive() {
+		fmt.Fprintln(os.Stderr, "Error: Not running in a terminal, so the message can't be confirmed interactively. Use --yes to commit without prompting, or --dry-run to only print the message.")
+		os.Exit(exitError)
+	}
+
+	if autoSplit {
+		if hookFile != "" || operation != "" {
+			fmt.Fprintln(os.Stderr, "Error: --auto-split can't be used from a hook or during a rebase or merge")
+			os.Exit(exitUsage)
+		}
+		if fixedSubject != "" {
+			fmt.Fprintln(os.Stderr, "Error: --auto-split can't be used with --subject, since each commit needs its own subject")
+			os.Exit(exitUsage)
+		}
+		err := runAutoSplit(provider, selected.Name, model, branch)
+		if err == nil {
+			pushIfRequested()
+			return
+		}
+		if err == errAborted {
+			os.Exit(exitAborted)
+		}
+		if err != errNothingToSplit {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		info("Only one hunk is staged, so there's nothing to split. Committing it as usual.")
 	}
 
 	// Get git diff for staged changes
@@ -106,9 +2401,14 @@ func main() {
 	diffContext, err := exec.Command("git", "diff", "--cached").Output()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error getting git diff:", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	debug("Diff length: %d bytes", len(diffContext))
+	if tree, err := writeStagedTree(); err == nil {
+		stagedTree = tree
+	} else {
+		debug("Could not record staged tree: %v", err)
+	}
 	debug("Diff: %s", string(diffContext))
 
 	// Get list of new staged files
@@ -116,171 +2416,515 @@ func main() {
 	newFilesOutput, err := exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=A").Output()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error getting new staged files:", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	newFiles := strings.Fields(string(newFilesOutput))
 	debug("New staged files: %v", newFiles)
 
 	// Check if there are any staged changes at all
-	if len(diffContext) == 0 && len(newFiles) == 0 {
+	emptyCommit := len(diffContext) == 0 && len(newFiles) == 0
+	if emptyCommit && !allowEmpty {
 		fmt.Fprintln(os.Stderr, "Error: No staged changes found")
-		os.Exit(1)
+		os.Exit(exitNoChanges)
+	}
+
+	// Binary files only show up as "Binary files differ" in the diff, so
+	// summarise them separately
+	debug("Getting staged binary files...")
+	binaries, textChanges, err := stagedBinaryChanges()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting staged binary files:", err)
+		os.Exit(exitError)
 	}
+	debug("Staged binary files: %d, text files: %d", len(binaries), textChanges)
 
-	// If there are new files, we need to get their content and add it to the diff
-	if len(newFiles) > 0 {
+	var notes []string
+	if len(binaries) > 0 {
+		if textChanges == 0 {
+			info("Warning: Only binary files are staged; the message will be based on file names and sizes")
+		}
+		notes = append(notes, binarySummary(binaries))
+	}
+
+	debug("Getting staged mode changes...")
+	modeChanges, err := stagedModeChanges()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting staged mode changes:", err)
+		os.Exit(exitError)
+	}
+	debug("Staged mode changes: %v", modeChanges)
+	if len(modeChanges) > 0 {
+		notes = append(notes, modeSummary(modeChanges))
+	}
+
+	debug("Getting staged renames...")
+	renames, err := stagedRenames()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting staged renames:", err)
+		os.Exit(exitError)
+	}
+	debug("Staged renames: %v", renames)
+	if len(renames) > 0 {
+		notes = append(notes, renameSummary(renames))
+	}
+
+	debug("Getting staged submodule updates...")
+	submodules, err := stagedSubmodules()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting staged submodule updates:", err)
+		os.Exit(exitError)
+	}
+	debug("Staged submodule updates: %v", submodules)
+	if len(submodules) > 0 {
+		notes = append(notes, submoduleSummary(submodules))
+	}
+
+	// New files matching --skip-content-ext (lock files, SVGs, minified code)
+	// are only listed by name
+	skipContent := make(map[string]bool)
+	if exts := splitList(skipContentExt); len(exts) > 0 {
+		var skipped []string
+		for _, file := range newFiles {
+			if hasExtension(file, exts) && !isBinaryChange(binaries, file) {
+				skipContent[file] = true
+				skipped = append(skipped, file)
+			}
+		}
+		if len(skipped) > 0 {
+			debug("Leaving out the content of %v (--skip-content-ext)", skipped)
+			diffContext = []byte(excludeFiles(string(diffContext), skipContent))
+			notes = append(notes, "These files were added too, but their contents were left out:\n- "+strings.Join(skipped, "\n- "))
+		}
+	}
+
+	// If there are new files, we need to get their content and add it to the
+	// diff. It's also kept separately for --word-diff, which replaces git's
+	// part of the diff.
+	newFileContent := ""
+	if len(newFiles) > 0 && !minimalMode && !noNewFileContent {
 		debug("Getting diff for new staged files...")
 		for _, file := range newFiles {
-			fileContent, err := os.ReadFile(file)
+			if isBinaryChange(binaries, file) {
+				debug("Skipping content of binary file %s", file)
+				continue
+			}
+			if isSubmodule(submodules, file) {
+				debug("Skipping content of submodule %s", file)
+				continue
+			}
+			if skipContent[file] {
+				continue
+			}
+			fileContent, err := stagedFileContent(file)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error reading file %s: %v\n", file, err)
-				os.Exit(1)
+				os.Exit(exitError)
 			}
-			diffContent := fmt.Sprintf("\n--- /dev/null\n+++ b/%s\n%s", file, string(fileContent))
+			diffContent := fmt.Sprintf("\ndiff --git a/%s b/%s\n--- /dev/null\n+++ b/%s\n%s", file, file, file, string(fileContent))
 			diffContext = append(diffContext, []byte(diffContent)...)
+			newFileContent += diffContent
 		}
 	}
 
 	// Get recent commits
 	debug("Getting recent commits...")
-	recentCommits, err := exec.Command("git", "log", "-3", "--pretty=format:%B").Output()
+	recentCommits, err := recentCommitMessages()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error getting recent commits:", err)
-		os.Exit(1)
+		// Most likely a fresh repo with no commits yet, so there's no style to copy
+		debug("Skipping recent commits, git log failed: %v", err)
+		recentCommits = nil
 	}
 	debug("Recent commits length: %d bytes", len(recentCommits))
 
-	debug("Final diff: %s", string(diffContext))
-
-	// Prepare prompt
-	prompt := fmt.Sprintf(`Generate a git commit message following this structure:
-1. First line: conventional commit format (type: concise description) (remember to use semantic types like feat, fix, docs, style, refactor, perf, test, chore, etc.)
-2. Optional bullet points if more context helps:
-   - Keep the second line blank
-   - Keep them short and direct
-   - Focus on what changed
-   - Always be terse
-   - Don't overly explain
-   - Drop any fluffy or formal language
-
-Return ONLY the commit message - no introduction, no explanation, no quotes around it.
+	// Files in other encodings (e.g. latin-1) would otherwise reach the API as
+	// invalid UTF-8
+	if !utf8.Valid(diffContext) {
+		info("Warning: The diff contains invalid UTF-8 (non-UTF-8 files?), invalid bytes will be replaced")
+	}
+	sanitizer := stagedSanitizer()
+	diffContext = []byte(sanitizeDiff(string(diffContext), sanitizer))
+	newFileContent = sanitizeDiff(newFileContent, sanitizer)
+	recentCommits = bytes.ToValidUTF8(recentCommits, []byte("\uFFFD"))
 
-Examples:
-feat: add user auth system
+	debug("Final diff: %s", string(diffContext))
 
-- Add JWT tokens for API auth
-- Handle token refresh for long sessions
+	// Suggest --breaking when the diff looks like it removes or changes public API
+	breakingReasons := detectBreakingChanges(string(diffContext))
+	debug("Possible breaking changes: %v", breakingReasons)
+	if breakingChange {
+		// The reasons name the changed declarations
+		if anonymizeMode {
+			breakingReasons = nil
+		}
+		notes = append(notes, breakingNote(breakingReasons))
+	} else if len(breakingReasons) > 0 {
+		info("Hint: This change may be breaking, consider re-running with --breaking:")
+		for _, reason := range breakingReasons {
+			info("  - %s", reason)
+		}
+	}
 
-fix: resolve memory leak in worker pool
+	if useBranchContext && branch != "HEAD" {
+		notes = append(notes, branchNote(branch))
+	}
+	if maxBodyLines > 0 {
+		notes = append(notes, fmt.Sprintf("Use at most %d lines (bullet points) after the subject.", maxBodyLines))
+	}
+	if fixedSubject != "" {
+		notes = append(notes, fmt.Sprintf("The author already wrote the subject line: %q. Write ONLY the body: short, terse bullet points describing the diff, consistent with that subject. Don't repeat the subject.", fixedSubject))
+	}
+	if cfg.Language != "" {
+		notes = append(notes, fmt.Sprintf("Write the description and bullet points in %s, but keep the conventional commit type in English.", cfg.Language))
+	}
+	if imperativeMode {
+		notes = append(notes, `Write the subject in the imperative mood, as if giving a command: "add", "fix", "remove", never "added", "adds" or "adding". The bullet points should start with an imperative verb too.`)
+	}
+	if emojiMode {
+		notes = append(notes, "Start the subject with the type, not an emoji, even if recent commits start with one. The emoji is added afterwards.")
+	}
+	if contextCmd != "" {
+		note, err := contextCmdNote(contextCmd)
+		if err != nil {
+			info("Warning: Could not run --context-cmd: %v", err)
+		} else {
+			notes = append(notes, note)
+		}
+	}
+	if len(userContext) > 0 {
+		notes = append(notes, contextNote(userContext))
+	}
+	if appendMode {
+		if existing := hookMessage(hookFile); existing != "" {
+			debug("Appending to the existing message: %q", existing)
+			notes = append(notes, appendNote(existing))
+		}
+	}
+	for _, path := range contextFiles() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			info("Warning: Could not read %s: %v", path, err)
+			continue
+		}
+		debug("Including %s (%d bytes)", path, len(content))
+		notes = append(notes, contextFileNote(string(content)))
+	}
 
-- Clean up idle connections
-- Add timeout for stale workers
+	// Large diffs get summarized per file first so each call stays within the
+	// model's context
+	promptDiff := string(diffContext)
+	if wordDiff && sanitizer.dropped > 0 {
+		debug("Using the normal diff, since a word diff can't leave out commit:ignore regions")
+	} else if wordDiff {
+		if words := stagedWordDiff(); words != "" {
+			promptDiff = words + newFileContent
+			notes = append(notes, "The diff is a word diff: removed words are shown as [-like this-] and added words as {+like this+}.")
+		} else {
+			debug("Word diff has no word changes, using the normal diff")
+		}
+	}
+	if selectMode {
+		excluded := selectFiles(diffFiles(promptDiff))
+		if len(excluded) > 0 {
+			promptDiff = excludeFiles(promptDiff, excluded)
+			var names []string
+			for _, path := range diffFiles(string(diffContext)) {
+				if excluded[path] {
+					names = append(names, path)
+				}
+			}
+			debug("Excluded from the prompt: %v", names)
+			notes = append(notes, "These files are also part of the commit, but their diffs were left out on purpose. Mention them only briefly, if at all:\n- "+strings.Join(names, "\n- "))
+		}
+	}
+	if summarizeLarge && !minimalMode {
+		if large := largeFiles(promptDiff, largeFileBytes); len(large) > 0 {
+			debug("Summarizing large files: %v", large)
+			excluded := make(map[string]bool)
+			for _, path := range large {
+				excluded[path] = true
+			}
+			promptDiff = excludeFiles(promptDiff, excluded)
+			notes = append(notes, largeFileNote(large))
+		}
+	}
+	if minimalMode {
+		debug("Getting diff stat for minimal mode...")
+		stat, err := exec.Command("git", "diff", "--cached", "--stat").Output()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting diff stat:", err)
+			os.Exit(exitError)
+		}
+		promptDiff = "Only a summary of the diff is available (from git diff --stat):\n\n" + string(stat)
+	} else if summarizeLongDiff && len(diffContext) > summarizeThreshold {
+		debug("Diff exceeds %d bytes, summarizing per file...", summarizeThreshold)
+		info("Diff is large, summarizing it before generating the message...")
+		if anonymizeMode {
+			promptDiff = anonymizeDiff(promptDiff)
+		}
+		summaries, err := summarizeDiff(provider, model, promptDiff, summarizeThreshold)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error summarizing diff:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		debug("Diff summaries: %s", summaries)
+		promptDiff = "The full diff was too large to include. Here is a per-file summary of it instead:\n\n" + summaries
+	} else {
+		var omittedNotes []string
+		promptDiff, omittedNotes = preparePromptDiff(promptDiff, nil)
+		notes = append(notes, omittedNotes...)
+	}
 
-Simple change example:
-fix: typo in README.md
+	// Prepare prompt
+	prompt := buildPrompt(string(recentCommits), promptDiff, notes)
+	if emptyCommit {
+		debug("No staged changes, generating a message for an empty commit")
+		intents := userContext
+		if emptyNote != "" {
+			intents = append([]string{emptyNote}, intents...)
+		}
+		prompt = buildEmptyCommitPrompt(string(recentCommits), branch, intents)
+	}
 
-Very important: Do not respond with any of the examples. Your message must be based off the diff that is about to be provided, with a little bit of styling informed by the recent commits you're about to see.
+	// Catch enormous prompts before they turn into an expensive request
+	if err := checkMessagePrompt(selected.Name, model, prompt); err != nil {
+		os.Exit(exitCodeFor(err))
+	}
 
-Recent commits from this repo (for style reference):
-%s
+	// Tiny edits like a whitespace fix aren't worth an API call. New and
+	// binary files are never trivial, since their lines don't show the change.
+	trivial := false
+	if minDiffBytes > 0 && !emptyCommit && len(newFiles) == 0 && len(binaries) == 0 {
+		changed := changedBytes(string(diffContext))
+		debug("Changed bytes: %d", changed)
+		trivial = changed < minDiffBytes
+	}
 
-Here's the current diff. Your commit message should be based off this diff:
+	key := cacheKey(selected.Name, model, prompt)
+	commitMsg, cached := "", false
+	if useCache {
+		commitMsg, cached = cachedMessage(key, cacheTTL)
+	}
+	switch {
+	case cached:
+		info("Using the cached message for this diff (--cache)")
+	case trivial:
+		info("The change is below --min-diff-bytes, so a local message is used without calling the API. Choose (m)odel to generate one instead.")
+		commitMsg = trivialMessage(diffFiles(string(diffContext)))
+	default:
+		debug("Sending request to %s API...", selected.Name)
+		commitMsg, err = generateMessage(provider, model, prompt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		if useCache {
+			storeMessage(key, commitMsg)
+		}
 
-%s`, string(recentCommits), string(diffContext))
+		if chain, ok := provider.(*fallbackProvider); ok {
+			info("Message generated by %s", chain.used)
+		}
+	}
 
-	// Prepare request
-	reqBody := AnthropicRequest{
-		Model:     "claude-3-sonnet-20240229",
-		MaxTokens: 300,
-		Messages: []Message{
-			{Role: "user", Content: prompt},
-		},
+	// With --enforce-types a wrong type gets one retry, then it's an error.
+	// A --subject is the user's choice, so it isn't checked.
+	if problem := commitTypeProblem(normalizeMessage(commitMsg)); enforceTypes && problem != "" && fixedSubject == "" {
+		info("%s, regenerating...", problem)
+		retry := fmt.Sprintf("%s\n\nImportant: A previous answer was rejected because: %s. The subject MUST start with one of these types: %s.", prompt, problem, strings.Join(commitTypes, ", "))
+		commitMsg, err = generateMessage(provider, model, retry)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		if problem := commitTypeProblem(normalizeMessage(commitMsg)); problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: %s (--enforce-types):\n%s\n", problem, commitMsg)
+			os.Exit(exitError)
+		}
 	}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error marshaling request:", err)
-		os.Exit(1)
+	// With --reject-generic a vague subject like "fix bug" gets one retry.
+	// The local --min-diff-bytes message is meant to be generic.
+	if phrase := genericPhrase(normalizeMessage(commitMsg)); rejectGeneric && phrase != "" && !trivial && fixedSubject == "" {
+		info("Warning: The subject %q is too generic to be useful (--reject-generic)", phrase)
+		if autoAccept || dryRun || confirm("Regenerate it? [y/N] ") {
+			info("Regenerating...")
+			retry := fmt.Sprintf("%s\n\nImportant: A previous answer was rejected because its subject, %q, is too generic. Say specifically what changed, e.g. which feature, function or behavior.", prompt, phrase)
+			if regenerated, err := generateMessage(provider, model, retry); err != nil {
+				info("Warning: Could not regenerate the message: %v", err)
+			} else {
+				commitMsg = regenerated
+				if phrase := genericPhrase(normalizeMessage(commitMsg)); phrase != "" {
+					info("Warning: The new subject %q is still generic", phrase)
+				}
+			}
+		}
 	}
 
-	debug("Sending request to Anthropic API...")
-	// Make API request
-	req, err := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error creating request:", err)
-		os.Exit(1)
+	// With --imperative a subject like "added X" gets one retry. The check only
+	// knows English verb endings, so it's skipped when the config sets a
+	// language.
+	if verb := nonImperativeVerb(normalizeMessage(commitMsg)); imperativeMode && verb != "" && !trivial && fixedSubject == "" && cfg.Language == "" {
+		info("The subject starts with %q, which isn't in the imperative mood, regenerating...", verb)
+		retry := fmt.Sprintf("%s\n\nImportant: A previous answer was rejected because its subject started with %q. Start the description with the imperative form of the verb, e.g. \"add\" instead of \"added\" or \"adds\".", prompt, verb)
+		if regenerated, err := generateMessage(provider, model, retry); err != nil {
+			info("Warning: Could not regenerate the message: %v", err)
+		} else {
+			commitMsg = regenerated
+			if verb := nonImperativeVerb(normalizeMessage(commitMsg)); verb != "" {
+				info("Warning: The new subject still starts with %q", verb)
+			}
+		}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	commitMsg = postProcess(commitMsg)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error making request:", err)
-		os.Exit(1)
+	summary := preCommitSummary(branch, binaries)
+
+	generated := commitMsg
+	record := func(status, final string) {
+		recordHistory(historyEntry{Branch: branch, Model: model, Status: status, Message: generated, Final: final})
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response:", err)
-		os.Exit(1)
+	if dryRun {
+		debug("Dry run, not committing")
+		record("generated", "")
+		if outputFile == "" {
+			fmt.Println(commitMsg)
+			return
+		}
+		if err := writeOutput(commitMsg); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing message:", err)
+			os.Exit(exitError)
+		}
+		return
 	}
 
-	debug("Received response from API")
-	// Parse response
-	var anthropicResp AnthropicResponse
-	if err := json.Unmarshal(body, &anthropicResp); err != nil {
-		fmt.Fprintln(os.Stderr, "Error parsing response:", err)
-		os.Exit(1)
+	if autoAccept {
+		debug("Accepting commit message without prompting (--yes)")
+		if !quietMode {
+			fmt.Fprintf(os.Stderr, "\nCommit message:\n------------------\n%s\n------------------\n%s\n", commitMsg, summary)
+		}
+		if err := finishCommit(commitMsg); err != nil {
+			record("failed", "")
+			fmt.Fprintln(os.Stderr, "Error committing changes:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		record("accepted", "")
+		pushIfRequested()
+		return
 	}
 
-	if len(anthropicResp.Content) > 0 {
-		commitMsg := strings.TrimSpace(anthropicResp.Content[0].Text)
+	printSuggestion(commitMsg, summary)
 
-		// Remove dry-run check and go straight to interactive mode
-		fmt.Fprintf(os.Stderr, "\nSuggested commit message:\n------------------\n%s\n------------------\n", commitMsg)
-		fmt.Fprintf(os.Stderr, "\nDo you want to (a)ccept, (e)dit, or (r)eject this message? ")
+	for {
+		choice := getInput("")
+		if choice == "" {
+			choice = defaultAction
+		}
+		switch choice {
+		case "a", "accept":
+			debug("Accepting commit message")
+			if err := finishCommit(commitMsg); err != nil {
+				// Keep the message so a rejected commit (e.g. by a hook) can be
+				// fixed up and retried without regenerating
+				fmt.Fprintln(os.Stderr, "Error committing changes:", err)
+				printSuggestion(commitMsg, summary)
+				continue
+			}
+			if commitMsg != generated {
+				// Changed with (s)cope
+				record("edited", commitMsg)
+			} else {
+				record("accepted", "")
+			}
+			pushIfRequested()
+			return
 
-		for {
-			choice := getInput("")
-			switch choice {
-			case "a", "accept":
-				debug("Accepting commit message")
-				if err := commitChanges(commitMsg); err != nil {
-					fmt.Fprintln(os.Stderr, "Error committing changes:", err)
-					os.Exit(1)
-				}
-				fmt.Fprintln(os.Stderr, "Changes committed successfully!")
-				return
-
-			case "e", "edit":
-				debug("Editing commit message")
-				edited, err := editMessage(commitMsg)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Error editing message:", err)
-					os.Exit(1)
-				}
-				if err := commitChanges(edited); err != nil {
-					fmt.Fprintln(os.Stderr, "Error committing changes:", err)
-					os.Exit(1)
-				}
-				fmt.Fprintln(os.Stderr, "Changes committed successfully!")
-				return
+		case "e", "edit":
+			debug("Editing commit message")
+			edited, err := editMessage(commitMsg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error editing message:", err)
+				printSuggestion(commitMsg, summary)
+				continue
+			}
+			commitMsg = edited
+			if err := finishCommit(commitMsg); err != nil {
+				fmt.Fprintln(os.Stderr, "Error committing changes:", err)
+				printSuggestion(commitMsg, summary)
+				continue
+			}
+			record("edited", commitMsg)
+			pushIfRequested()
+			return
+
+		case "s", "scope":
+			suggested, err := suggestScope(provider, model, commitMsg, diffFiles(string(diffContext)))
+			if err != nil {
+				debug("Could not suggest a scope: %v", err)
+			}
+			scope := getInput(fmt.Sprintf("Scope (Enter for %q, - to remove): ", suggested))
+			switch scope {
+			case "":
+				scope = suggested
+			case "-":
+				scope = ""
+			}
+			scoped, err := setScope(commitMsg, scope)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			} else {
+				commitMsg = scoped
+			}
+			printSuggestion(commitMsg, summary)
 
-			case "r", "reject":
-				debug("Rejecting commit message")
-				fmt.Fprintln(os.Stderr, "Commit message rejected. Exiting without committing.")
-				os.Exit(0)
+		case "m", "model":
+			newModel := chooseModel(selected.Models, model)
+			if newModel == "" {
+				printSuggestion(commitMsg, summary)
+				continue
+			}
+			debug("Regenerating with model %s", newModel)
+			info("Regenerating with %s...", newModel)
+			regenerated, err := generateMessage(provider, newModel, prompt)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				printSuggestion(commitMsg, summary)
+				continue
+			}
+			record("replaced", "")
+			model, commitMsg = newModel, postProcess(regenerated)
+			generated = commitMsg
+			printSuggestion(commitMsg, summary)
 
-			default:
-				fmt.Fprintf(os.Stderr, "Invalid choice. Please enter (a)ccept, (e)dit, or (r)eject: ")
+		case "c", "critique":
+			feedback := readLine("What should be different? (blank to cancel): ")
+			if feedback == "" {
+				printSuggestion(commitMsg, summary)
+				continue
+			}
+			debug("Regenerating with feedback %q", feedback)
+			info("Regenerating with your feedback...")
+			critiqued := fmt.Sprintf("%s\n\nA previous attempt was:\n%s\n\nThe author wants this changed: %s\nWrite a new message that addresses this.", prompt, commitMsg, feedback)
+			regenerated, err := generateMessage(provider, model, critiqued)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				printSuggestion(commitMsg, summary)
+				continue
 			}
+			record("replaced", "")
+			commitMsg = postProcess(regenerated)
+			generated = commitMsg
+			printSuggestion(commitMsg, summary)
+
+		case "r", "reject":
+			debug("Rejecting commit message")
+			record("rejected", "")
+			info("Commit message rejected. Exiting without committing.")
+			os.Exit(exitAborted)
+
+		default:
+			fmt.Fprintf(os.Stderr, "Invalid choice. Please enter (a)ccept, (e)dit, (m)odel, (c)ritique, (s)cope, or (r)eject: ")
 		}
-	} else {
-		fmt.Fprintln(os.Stderr, "Error: Empty response from API")
-		os.Exit(1)
 	}
 }
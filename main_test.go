@@ -0,0 +1,579 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"subject only", "feat: add x", "feat: add x"},
+		{"surrounding whitespace", "\n\n  feat: add x  \n\n", "feat: add x"},
+		{"body on line 2", "feat: add x\n- do y", "feat: add x\n\n- do y"},
+		{"several blank lines", "feat: add x\n\n\n\n- do y\n\n", "feat: add x\n\n- do y"},
+		{"blank lines in the body are kept", "feat: add x\n\n- do y\n\nBREAKING CHANGE: z", "feat: add x\n\n- do y\n\nBREAKING CHANGE: z"},
+		{"code fence", "```\nfeat: add x\n\n- do y\n```", "feat: add x\n\n- do y"},
+		{"code fence with language", "```text\nfeat: add x\n```", "feat: add x"},
+		{"double quotes", `"feat: add x"`, "feat: add x"},
+		{"single quotes", "'feat: add x'", "feat: add x"},
+		{"quotes inside are kept", `"feat: add "x" flag"`, `"feat: add "x" flag"`},
+		{"preamble", "Here's the commit message:\n\nfeat: add x\n- do y", "feat: add x\n\n- do y"},
+		{"preamble and fence", "Sure, here is the commit message:\n```\nfeat: add x\n```", "feat: add x"},
+		{"subject ending in a colon", "feat: add x:\n\n- do y", "feat: add x:\n\n- do y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeMessage(tt.message); got != tt.want {
+				t.Errorf("normalizeMessage(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"lf", "a\nb\n", "a\nb\n"},
+		{"crlf", "a\r\nb\r\n", "a\nb\n"},
+		{"lone cr", "a\rb\r", "a\nb\n"},
+		{"mixed", "a\r\nb\rc\n", "a\nb\nc\n"},
+		{"blank crlf lines", "a\r\n\r\nb", "a\n\nb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeNewlines(tt.in); got != tt.want {
+				t.Errorf("normalizeNewlines(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"none", "feat: add x", "feat: add x\n"},
+		{"one", "feat: add x\n", "feat: add x\n"},
+		{"several", "feat: add x\n\n\n", "feat: add x\n"},
+		{"crlf", "feat: add x\r\n\r\n", "feat: add x\n"},
+		{"spaces and tabs", "feat: add x \t\n  \n\t", "feat: add x\n"},
+		{"body", "feat: add x\n\n- do y\n\n", "feat: add x\n\n- do y\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withTrailingNewline(tt.message); got != tt.want {
+				t.Errorf("withTrailingNewline(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeDiffLatin1(t *testing.T) {
+	// "café" and "naïve" encoded as latin-1, as git shows files in that encoding
+	diff := "diff --git a/menu.txt b/menu.txt\n--- a/menu.txt\n+++ b/menu.txt\n@@ -1 +1 @@\n-caf\xe9\n+na\xefve caf\xe9\n"
+	if utf8.ValidString(diff) {
+		t.Fatal("test diff should contain invalid UTF-8")
+	}
+
+	prompt := buildPrompt("", sanitizeDiff(diff, &diffSanitizer{}), nil)
+	if !utf8.ValidString(prompt) {
+		t.Errorf("prompt is not valid UTF-8: %q", prompt)
+	}
+	if !strings.Contains(prompt, "+na\uFFFDve caf\uFFFD") {
+		t.Errorf("prompt doesn't contain the line with replaced bytes: %q", prompt)
+	}
+}
+
+// gitRepo creates a repository in a temporary directory and makes it the
+// working directory for the rest of the test
+func gitRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	git(t, "init", "-q", "-b", "main")
+	git(t, "config", "user.email", "test@example.com")
+	git(t, "config", "user.name", "Test")
+	return dir
+}
+
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+func TestRegionLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []int
+	}{
+		{"no markers", "a\nb\n", nil},
+		{"region", "a\n// commit:ignore-start\nb\nc\n// commit:ignore-end\nd\n", []int{2, 3, 4, 5}},
+		{"unterminated", "a\n# commit:ignore-start\nb\n", []int{2, 3}},
+		{"two regions", "commit:ignore-start\ncommit:ignore-end\na\ncommit:ignore-start\nb\ncommit:ignore-end\n", []int{1, 2, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := regionLines(tt.content)
+			if got == nil {
+				t.Fatal("regionLines returned nil")
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("regionLines() = %v, want lines %v", got, tt.want)
+			}
+			for _, line := range tt.want {
+				if !got[line] {
+					t.Errorf("line %d not in region, got %v", line, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeDiffRegionInDiff(t *testing.T) {
+	diff := "diff --git a/x b/x\n--- a/x\n+++ b/x\n@@ -1,4 +1,4 @@\n a\n // commit:ignore-start\n-old secret\n+new secret\n // commit:ignore-end\n"
+	got := sanitizeDiff(diff, &diffSanitizer{})
+	if strings.Contains(got, "secret") {
+		t.Errorf("region lines kept:\n%s", got)
+	}
+	if !strings.Contains(got, ignoredPlaceholder) || !strings.Contains(got, " a\n") {
+		t.Errorf("want placeholder and context, got:\n%s", got)
+	}
+}
+
+func TestSanitizeDiffRegionOutsideHunk(t *testing.T) {
+	gitRepo(t)
+	var lines []string
+	lines = append(lines, "package x", "", "// commit:ignore-start")
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("var filler%d = %d", i, i))
+	}
+	lines = append(lines, `const licenseKey = "OLD-SECRET"`)
+	for i := 20; i < 40; i++ {
+		lines = append(lines, fmt.Sprintf("var filler%d = %d", i, i))
+	}
+	lines = append(lines, "// commit:ignore-end")
+	for i := 0; i < 10; i++ {
+		lines = append(lines, "")
+	}
+	lines = append(lines, "var v = 1")
+	content := strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile("lic.go", []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "lic.go")
+	git(t, "commit", "-q", "-m", "add lic.go")
+
+	content = strings.Replace(content, "OLD-SECRET", "NEW-SECRET", 1)
+	content = strings.Replace(content, "var v = 1", "var v = 2", 1)
+	if err := os.WriteFile("lic.go", []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "lic.go")
+
+	diff := git(t, "diff", "--cached")
+	if strings.Contains(diff, ignoreStartMarker) || strings.Contains(diff, ignoreEndMarker) {
+		t.Fatalf("markers should be outside the hunk context:\n%s", diff)
+	}
+	got := sanitizeDiff(diff, stagedSanitizer())
+	if strings.Contains(got, "SECRET") {
+		t.Errorf("region lines kept:\n%s", got)
+	}
+	if !strings.Contains(got, ignoredPlaceholder) {
+		t.Errorf("no placeholder:\n%s", got)
+	}
+	if !strings.Contains(got, "+var v = 2") {
+		t.Errorf("change outside the region dropped:\n%s", got)
+	}
+}
+
+func TestNonImperativeVerb(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"feat: add login", ""},
+		{"feat: adds login", "adds"},
+		{"fix: fixes crash", "fixes"},
+		{"fix: applies patch", "applies"},
+		{"feat: added login", "added"},
+		{"fix: Fixed crash on start", "Fixed"},
+		{"chore: updated deps", "updated"},
+		{"fix: skipped empty files", "skipped"},
+		{"fix: applied the patch", "applied"},
+		{"refactor: using the new API", "using"},
+		{"fix: handling of nil maps", "handling"},
+		{"fix: dropping stale entries", "dropping"},
+		{"fix(ui): removed dead code", "removed"},
+		{"fix: padding on mobile", ""},
+		{"fix: unused import", ""},
+		{"feat: logging for x", ""},
+		{"refactor: nested config", ""},
+		{"fix: missing nil check", ""},
+		{"perf: caching layer", ""},
+		{"docs: typos in README", ""},
+		{"feat: embed assets", ""},
+		{"fix: string escaping", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := nonImperativeVerb(tt.message); got != tt.want {
+			t.Errorf("nonImperativeVerb(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestWithSubject(t *testing.T) {
+	saved := commitTypes
+	commitTypes = defaultCommitTypes
+	t.Cleanup(func() { commitTypes = saved })
+
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"body only", "- add x\n- fix y", "feat: add x\n\n- add x\n- fix y"},
+		{"model wrote a subject", "feat: something else\n\n- add x", "feat: add x\n\n- add x"},
+		{"model repeated the subject", "feat: add x\n\n- add x", "feat: add x\n\n- add x"},
+		{"body starts with a note", "Note: x is now cached\n- add x", "feat: add x\n\nNote: x is now cached\n- add x"},
+		{"empty body", "", "feat: add x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withSubject(tt.message, "feat: add x"); got != tt.want {
+				t.Errorf("withSubject(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateInLinkedWorktree(t *testing.T) {
+	dir := gitRepo(t)
+	if err := os.Mkdir("sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("sub", "f.txt"), []byte("base\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", ".")
+	git(t, "commit", "-q", "-m", "base")
+	git(t, "branch", "other")
+	if err := os.WriteFile(filepath.Join("sub", "f.txt"), []byte("main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "commit", "-q", "-am", "main change")
+
+	// .git is a file in a linked worktree
+	worktree := filepath.Join(dir, "wt")
+	git(t, "worktree", "add", "-q", worktree, "other")
+	if err := os.Chdir(filepath.Join(worktree, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if op := inProgressOperation(); op != "" {
+		t.Fatalf("inProgressOperation() = %q before merging, want none", op)
+	}
+
+	if err := os.WriteFile("f.txt", []byte("other\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "commit", "-q", "-am", "other change")
+	if err := exec.Command("git", "merge", "-q", "main").Run(); err == nil {
+		t.Fatal("expected the merge to conflict")
+	}
+	if op := inProgressOperation(); op != "merge" {
+		t.Errorf("inProgressOperation() = %q during a merge, want merge", op)
+	}
+	git(t, "merge", "--abort")
+
+	// Staged content, not what's in the working tree, from a subdirectory
+	if err := os.WriteFile("f.txt", []byte("staged\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "f.txt")
+	if err := os.WriteFile("f.txt", []byte("edited after add\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	content, err := stagedFileContent("sub/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "staged\n" {
+		t.Errorf("stagedFileContent() = %q, want %q", content, "staged\n")
+	}
+
+	// The worktree's merge state isn't the main working tree's
+	git(t, "commit", "-q", "-m", "staged")
+	if err := exec.Command("git", "merge", "-q", "main").Run(); err == nil {
+		t.Fatal("expected the merge to conflict")
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if op := inProgressOperation(); op != "" {
+		t.Errorf("inProgressOperation() = %q in the main working tree, want none", op)
+	}
+}
+
+const splitTestDiff = `diff --git a/a.go b/a.go
+index 1111111..2222222 100644
+--- a/a.go
++++ b/a.go
+@@ -1,2 +1,2 @@
+-one
++uno
+ two
+@@ -10,2 +10,2 @@
+-ten
++diez
+ eleven
+diff --git a/new.go b/new.go
+new file mode 100644
+index 0000000..3333333
+--- /dev/null
++++ b/new.go
+@@ -0,0 +1 @@
++package x
+diff --git a/b.go b/b.go
+index 4444444..5555555 100644
+--- a/b.go
++++ b/b.go
+@@ -1 +1 @@
+-b
++be
+`
+
+func TestSplitHunks(t *testing.T) {
+	hunks := splitHunks(splitTestDiff)
+	want := []struct {
+		file      int
+		path      string
+		bodyStart string
+	}{
+		{0, "a.go", "@@ -1,2 +1,2 @@"},
+		{0, "a.go", "@@ -10,2 +10,2 @@"},
+		// A new file can't be split, so it's one hunk with the whole file as its header
+		{1, "new.go", ""},
+		{2, "b.go", "@@ -1 +1 @@"},
+	}
+	if len(hunks) != len(want) {
+		t.Fatalf("splitHunks() returned %d hunks, want %d: %+v", len(hunks), len(want), hunks)
+	}
+	for i, w := range want {
+		h := hunks[i]
+		if h.File != w.file || h.Path != w.path || !strings.HasPrefix(h.Body, w.bodyStart) {
+			t.Errorf("hunk %d = %+v, want file %d, path %s, body starting %q", i+1, h, w.file, w.path, w.bodyStart)
+		}
+		if w.bodyStart == "" && h.Body != "" {
+			t.Errorf("hunk %d has body %q, want none", i+1, h.Body)
+		}
+	}
+	if !strings.Contains(hunks[2].Header, "+package x") {
+		t.Errorf("new file header = %q, want the whole file", hunks[2].Header)
+	}
+}
+
+func TestHunkPatch(t *testing.T) {
+	hunks := splitHunks(splitTestDiff)
+	tests := []struct {
+		name     string
+		selected []int
+		want     []string
+		wantNot  []string
+	}{
+		{"one hunk", []int{2}, []string{"diff --git a/a.go", "+diez"}, []string{"+uno", "b.go", "new.go"}},
+		{"header written once", []int{1, 2}, []string{"+uno", "+diez"}, []string{"b.go"}},
+		{"diff order", []int{4, 1}, []string{"+uno", "+be"}, []string{"+diez"}},
+		{"unsplittable file", []int{3}, []string{"new file mode", "+package x"}, []string{"a.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := hunkPatch(hunks, tt.selected)
+			// In this order
+			last := -1
+			for _, s := range tt.want {
+				i := strings.Index(patch, s)
+				if i < 0 {
+					t.Errorf("patch is missing %q:\n%s", s, patch)
+				} else if i < last {
+					t.Errorf("%q is out of diff order:\n%s", s, patch)
+				}
+				last = i
+			}
+			for _, s := range tt.wantNot {
+				if strings.Contains(patch, s) {
+					t.Errorf("patch has %q:\n%s", s, patch)
+				}
+			}
+			if n := strings.Count(patch, "diff --git"); n != len(uniqueFiles(hunks, tt.selected)) {
+				t.Errorf("patch has %d file headers:\n%s", n, patch)
+			}
+		})
+	}
+}
+
+func uniqueFiles(hunks []hunk, selected []int) map[int]bool {
+	files := make(map[int]bool)
+	for _, n := range selected {
+		files[hunks[n-1].File] = true
+	}
+	return files
+}
+
+func TestParseSplitPlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    int // number of groups
+		wantErr string
+	}{
+		{"valid", `[{"hunks":[1,3],"message":"feat: a"},{"hunks":[2],"message":"fix: b"}]`, 2, ""},
+		{"fenced", "```json\n[{\"hunks\":[1,2,3],\"message\":\"feat: a\"}]\n```", 1, ""},
+		{"not json", "Here are the commits", 0, "could not parse"},
+		{"missing hunk", `[{"hunks":[1,2],"message":"feat: a"}]`, 0, "cover 2 of 3"},
+		{"duplicate hunk", `[{"hunks":[1,2],"message":"feat: a"},{"hunks":[2,3],"message":"fix: b"}]`, 0, "more than one"},
+		{"out of range", `[{"hunks":[1,2,3,4],"message":"feat: a"}]`, 0, "hunk 4"},
+		{"no message", `[{"hunks":[1,2,3],"message":" "}]`, 0, "no message"},
+		{"no hunks", `[{"hunks":[],"message":"feat: a"},{"hunks":[1,2,3],"message":"fix: b"}]`, 0, "no hunks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, err := parseSplitPlan(tt.reply, 3)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSplitPlan() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSplitPlan() error = %v", err)
+			}
+			if len(groups) != tt.want {
+				t.Errorf("parseSplitPlan() = %d groups, want %d", len(groups), tt.want)
+			}
+		})
+	}
+}
+
+// fileDiff builds a diff of a file that adds lines lines
+func fileDiff(path string, lines int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n@@ -0,0 +1,%d @@\n", path, path, path, path, lines)
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "+line %d\n", i)
+	}
+	return sb.String()
+}
+
+func TestPrioritizeDiff(t *testing.T) {
+	source, test, generated := fileDiff("main.go", 5), fileDiff("main_test.go", 5), fileDiff("go.sum", 5)
+	diff := generated + test + source
+	tests := []struct {
+		name        string
+		budget      int
+		wantFiles   []string
+		wantOmitted []string
+		truncated   bool
+	}{
+		{"no budget", 0, []string{"go.sum", "main_test.go", "main.go"}, nil, false},
+		{"fits", len(diff), []string{"go.sum", "main_test.go", "main.go"}, nil, false},
+		{"drops generated files first", len(source) + len(test), []string{"main.go", "main_test.go"}, []string{"go.sum"}, false},
+		{"then tests", len(source) + 10, []string{"main.go"}, []string{"main_test.go", "go.sum"}, false},
+		{"cuts the most important file", 40, []string{"main.go"}, []string{"main_test.go", "go.sum"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, omitted := prioritizeDiff(diff, tt.budget)
+			if files := diffFiles(got); strings.Join(files, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Errorf("kept files %v, want %v", files, tt.wantFiles)
+			}
+			if strings.Join(omitted, ",") != strings.Join(tt.wantOmitted, ",") {
+				t.Errorf("omitted %v, want %v", omitted, tt.wantOmitted)
+			}
+			if truncated := strings.Contains(got, "... (truncated)"); truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v:\n%s", truncated, tt.truncated, got)
+			}
+			if tt.budget > 0 && !tt.truncated && len(got) > tt.budget {
+				t.Errorf("kept %d bytes, over the %d byte budget", len(got), tt.budget)
+			}
+		})
+	}
+}
+
+func TestTruncateFileLines(t *testing.T) {
+	hunks := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1,4 +1,4 @@\n ctx\n-old\n+new\n ctx\n+more\n"
+	appended := "diff --git a/new.go b/new.go\n--- /dev/null\n+++ b/new.go\none\ntwo\nthree\n"
+	tests := []struct {
+		name     string
+		diff     string
+		maxLines int
+		want     string
+	}{
+		{"no limit", hunks, 0, hunks},
+		{"under the limit", hunks, 10, hunks},
+		{"counts only changed lines", hunks, 2, "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1,4 +1,4 @@\n ctx\n-old\n... 2 more lines changed\n"},
+		{"appended contents", appended, 1, "diff --git a/new.go b/new.go\n--- /dev/null\n+++ b/new.go\none\n... 2 more lines changed\n"},
+		{"each file on its own", hunks + appended, 2, "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1,4 +1,4 @@\n ctx\n-old\n... 2 more lines changed\n" + "diff --git a/new.go b/new.go\n--- /dev/null\n+++ b/new.go\none\ntwo\n... 1 more lines changed\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateFileLines(tt.diff, tt.maxLines); got != tt.want {
+				t.Errorf("truncateFileLines() =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCodeFor(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, exitOK},
+		{"other error", errors.New("boom"), exitError},
+		{"nothing staged", errNothingStaged, exitNoChanges},
+		{"nothing staged, wrapped", fmt.Errorf("%w: stage them again", errNothingStaged), exitNoChanges},
+		{"aborted", errAborted, exitAborted},
+		{"usage", usageError{errors.New("unsupported provider")}, exitUsage},
+		{"API error", fmt.Errorf("anthropic: %w", &apiError{StatusCode: 401}), exitAPIError},
+		{"network error", &url.Error{Op: "Post", URL: "https://example.com", Err: errors.New("refused")}, exitAPIError},
+		{"empty response", errEmptyResponse, exitAPIError},
+		{"cut off response", errCutOffResponse, exitAPIError},
+		{"every provider failed", errors.Join(fmt.Errorf("anthropic: %w", &apiError{StatusCode: 500}), fmt.Errorf("openai: %w", errEmptyResponse)), exitAPIError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCodeFor(tt.err); got != tt.want {
+				t.Errorf("exitCodeFor(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+type OllamaRequest struct {
+	Model    string         `json:"model"`
+	Messages []Message      `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  map[string]any `json:"options,omitempty"`
+}
+
+type OllamaResponse struct {
+	Message         Message `json:"message"`
+	DoneReason      string  `json:"done_reason"`
+	PromptEvalCount int     `json:"prompt_eval_count"`
+	EvalCount       int     `json:"eval_count"`
+}
+
+// ollamaProvider talks to a local Ollama server, which needs no API key
+type ollamaProvider struct {
+	usage usage
+}
+
+func (p *ollamaProvider) LastUsage() usage {
+	return p.usage
+}
+
+// ollamaHost returns OLLAMA_HOST, defaulting to the local server
+func ollamaHost() string {
+	host := os.Getenv("OLLAMA_HOST")
+	if host == "" {
+		return "http://localhost:11434"
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// Complete calls the chat API with streaming off and returns the reply
+func (p *ollamaProvider) Complete(model, prompt string, maxTokens int) (string, error) {
+	reqBody := OllamaRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "user", Content: prompt},
+		},
+		Options: map[string]any{"num_predict": maxTokens},
+	}
+	if cfg.Temperature != nil {
+		reqBody.Options["temperature"] = *cfg.Temperature
+	}
+
+	body, err := postJSON(ollamaHost()+"/api/chat", nil, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	var ollamaResp OllamaResponse
+	if err := parseResponse(body, &ollamaResp); err != nil {
+		return "", err
+	}
+	p.usage = usage{InputTokens: ollamaResp.PromptEvalCount, OutputTokens: ollamaResp.EvalCount, Truncated: ollamaResp.DoneReason == "length"}
+
+	if ollamaResp.Message.Content == "" {
+		return "", errEmptyResponse
+	}
+	return strings.TrimSpace(ollamaResp.Message.Content), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import "strings"
+
+type OpenAIRequest struct {
+	Model       string    `json:"model"`
+	MaxTokens   int       `json:"max_tokens"`
+	Messages    []Message `json:"messages"`
+	Stop        []string  `json:"stop,omitempty"`
+	Temperature *float64  `json:"temperature,omitempty"`
+}
+
+type OpenAIResponse struct {
+	Choices []struct {
+		Message      Message `json:"message"`
+		FinishReason string  `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+type openAIProvider struct {
+	apiKey string
+	usage  usage
+}
+
+func (p *openAIProvider) LastUsage() usage {
+	return p.usage
+}
+
+// Complete calls the chat completions API and returns the first choice
+func (p *openAIProvider) Complete(model, prompt string, maxTokens int) (string, error) {
+	reqBody := OpenAIRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []Message{
+			{Role: "user", Content: prompt},
+		},
+		Temperature: cfg.Temperature,
+	}
+	// The chat completions API accepts at most 4 stop sequences
+	if len(stopSequences) <= 4 {
+		reqBody.Stop = stopSequences
+	} else {
+		reqBody.Stop = stopSequences[:4]
+	}
+
+	body, err := postJSON("https://api.openai.com/v1/chat/completions", map[string]string{
+		"Authorization": "Bearer " + p.apiKey,
+	}, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	var openAIResp OpenAIResponse
+	if err := parseResponse(body, &openAIResp); err != nil {
+		return "", err
+	}
+	p.usage = usage{InputTokens: openAIResp.Usage.PromptTokens, OutputTokens: openAIResp.Usage.CompletionTokens}
+	if len(openAIResp.Choices) > 0 {
+		p.usage.Truncated = openAIResp.Choices[0].FinishReason == "length"
+	}
+
+	if len(openAIResp.Choices) == 0 || openAIResp.Choices[0].Message.Content == "" {
+		return "", errEmptyResponse
+	}
+	return strings.TrimSpace(openAIResp.Choices[0].Message.Content), nil
+}
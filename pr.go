@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+)
+
+// runPR implements the "pr" subcommand, which prints a pull request title and
+// description for the current branch without committing anything
+func runPR(p Provider, providerName, model string, args []string) error {
+	fs := flag.NewFlagSet("pr", flag.ContinueOnError)
+	base := fs.String("base", "main", "Base branch the pull request will merge into")
+	parseFlags(fs, args)
+
+	debug("Getting commits since %s...", *base)
+	commits, err := exec.Command("git", "log", "--pretty=format:%B", *base+"..HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("error getting commits since %s: %w", *base, err)
+	}
+
+	// Three dots diffs against the merge base, so unrelated changes on the base
+	// branch aren't included
+	debug("Getting diff against %s...", *base)
+	diff, err := exec.Command("git", "diff", *base+"...HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("error getting diff against %s: %w", *base, err)
+	}
+	if len(bytes.TrimSpace(diff)) == 0 {
+		return fmt.Errorf("no changes between %s and HEAD", *base)
+	}
+	promptDiff, notes := preparePromptDiff(string(diff), rangeSanitizer(*base+"...HEAD"))
+	for _, note := range notes {
+		promptDiff += "\n\n" + note
+	}
+
+	prompt := fmt.Sprintf(`Write a pull request title and description for the changes below.
+
+Use exactly this format:
+<title: a short, specific summary of the change>
+
+## Summary
+<one or two sentences on what the change does and why>
+
+## Changes
+- <terse bullet per notable change>
+
+## Testing
+- <how the change was or should be verified>
+
+Return ONLY the title and description - no introduction, no explanation, no quotes around it.
+
+Commits on this branch:
+%s
+
+Diff against %s:
+%s`, string(commits), *base, promptDiff)
+	if err := checkPrompt(providerName, model, prompt, 1500); err != nil {
+		return err
+	}
+
+	pr, err := complete(p, model, prompt, 1500)
+	if err != nil {
+		return err
+	}
+	fmt.Println(pr)
+	return nil
+}
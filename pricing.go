@@ -0,0 +1,73 @@
+package main
+
+import "strings"
+
+// modelPrice is a model's list price in US dollars per million tokens
+type modelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// modelPrices are the list prices used by --estimate and --cost-warn. Dated
+// model names (e.g. claude-3-5-haiku-20241022) match by prefix.
+var modelPrices = map[string]modelPrice{
+	"claude-3-haiku":    {Input: 0.25, Output: 1.25},
+	"claude-3-opus":     {Input: 15, Output: 75},
+	"claude-3-5-haiku":  {Input: 0.8, Output: 4},
+	"claude-3-5-sonnet": {Input: 3, Output: 15},
+	"claude-3-7-sonnet": {Input: 3, Output: 15},
+	"claude-sonnet-4":   {Input: 3, Output: 15},
+	"claude-opus-4":     {Input: 15, Output: 75},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.6},
+	"gpt-4o":            {Input: 2.5, Output: 10},
+	"gpt-4.1-mini":      {Input: 0.4, Output: 1.6},
+	"gpt-4.1":           {Input: 2, Output: 8},
+}
+
+// lookupPrice finds the price of a model, preferring the longest matching
+// prefix so "gpt-4o-mini" isn't priced as "gpt-4o"
+func lookupPrice(model string) (modelPrice, bool) {
+	var price modelPrice
+	best := ""
+	for name, p := range modelPrices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			price, best = p, name
+		}
+	}
+	return price, best != ""
+}
+
+// estimateCost returns the approximate cost in US dollars of a request, and
+// whether the model's price is known. Local models are free.
+func estimateCost(provider, model string, inputTokens, outputTokens int) (float64, bool) {
+	if provider == "ollama" {
+		return 0, true
+	}
+	price, ok := lookupPrice(model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(inputTokens)*price.Input + float64(outputTokens)*price.Output) / 1e6, true
+}
+
+// checkCost prints the --estimate and asks before sending a request
+// estimated to cost more than --cost-warn, returning errAborted if the user
+// declines
+func checkCost(provider, model string, inputTokens, outputTokens int) error {
+	cost, priced := estimateCost(provider, model, inputTokens, outputTokens)
+	if estimateMode {
+		if priced {
+			info("Estimated request: about %d input tokens, up to %d output tokens, about $%.4f with %s", inputTokens, outputTokens, cost, model)
+		} else {
+			info("Estimated request: about %d input tokens, up to %d output tokens (no price known for %s)", inputTokens, outputTokens, model)
+		}
+	}
+	if costWarn > 0 && priced && cost > costWarn {
+		info("Warning: The request is estimated to cost about $%.4f, above the $%g threshold (--cost-warn)", cost, costWarn)
+		if !autoAccept && !confirm("Send it anyway? [y/N] ") {
+			info("Aborted without calling the API.")
+			return errAborted
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var errEmptyResponse = errors.New("empty response from API")
+
+// errCutOffResponse means the response body ended early, most likely because
+// the connection dropped, so the request is worth retrying
+var errCutOffResponse = errors.New("the response from the API was cut off (connection dropped?)")
+
+// apiError is a non-2xx response from a provider's API
+type apiError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API returned %s: %s", e.Status, e.Body)
+}
+
+// Provider sends a single-turn prompt to a model API and returns the reply
+type Provider interface {
+	Complete(model, prompt string, maxTokens int) (string, error)
+}
+
+// usage is the token count of a request, and whether the reply was cut off,
+// as reported by the API
+type usage struct {
+	InputTokens  int
+	OutputTokens int
+	// Truncated is set when the reply hit the token limit and was cut off
+	Truncated bool
+}
+
+// usageReporter is implemented by providers that can report the token usage
+// of their last request
+type usageReporter interface {
+	LastUsage() usage
+}
+
+// lastUsage returns the usage of p's last request, if it reports one
+func lastUsage(p Provider) (usage, bool) {
+	if r, ok := p.(usageReporter); ok {
+		return r.LastUsage(), true
+	}
+	return usage{}, false
+}
+
+type providerInfo struct {
+	Name string
+	// EnvVar holds the API key, or is empty for providers that don't need one
+	EnvVar string
+	// DefaultModel is used when no model is given, and when the provider is a
+	// fallback in --providers
+	DefaultModel string
+	// Models are offered by (m)odel and compared by bench by default
+	Models []string
+	New    func(apiKey string) Provider
+}
+
+// providers lists the supported providers in the order they're picked when
+// auto-detecting from the environment
+var providers = []providerInfo{
+	{
+		Name: "anthropic", EnvVar: "ANTHROPIC_API_KEY", DefaultModel: defaultModel,
+		Models: []string{"claude-3-5-haiku-latest", "claude-3-5-sonnet-latest", "claude-3-7-sonnet-latest", "claude-sonnet-4-0", "claude-opus-4-0"},
+		New:    func(apiKey string) Provider { return &anthropicProvider{apiKey: apiKey} },
+	},
+	{
+		Name: "openai", EnvVar: "OPENAI_API_KEY", DefaultModel: "gpt-4o-mini",
+		Models: []string{"gpt-4o-mini", "gpt-4o", "gpt-4.1-mini", "gpt-4.1"},
+		New:    func(apiKey string) Provider { return &openAIProvider{apiKey: apiKey} },
+	},
+	{
+		Name: "ollama", DefaultModel: "llama3.2",
+		Models: []string{"llama3.2", "llama3.1", "qwen2.5-coder", "mistral"},
+		New:    func(string) Provider { return &ollamaProvider{} },
+	},
+}
+
+func lookupProvider(name string) (providerInfo, bool) {
+	for _, p := range providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return providerInfo{}, false
+}
+
+// detectProvider picks the first provider, by priority, whose API key is set
+func detectProvider() (providerInfo, bool) {
+	for _, p := range providers {
+		if os.Getenv(p.EnvVar) != "" {
+			return p, true
+		}
+	}
+	return providerInfo{}, false
+}
+
+// listProviders prints the supported providers for --list-providers, with
+// the environment variable each needs and whether it's set
+func listProviders(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tENV VAR\tDEFAULT MODEL\tCREDENTIALS")
+	for _, p := range providers {
+		envVar, status := p.EnvVar, "not set"
+		switch {
+		case p.EnvVar == "":
+			envVar, status = "-", "none needed"
+		case os.Getenv(p.EnvVar) != "":
+			status = "detected"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, envVar, p.DefaultModel, status)
+	}
+	return w.Flush()
+}
+
+func providerNames() []string {
+	var names []string
+	for _, p := range providers {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// newProvider creates a provider using apiKey, or the key from the
+// environment if it's empty. A comma-separated list of keys gives a provider
+// that fails over to the next key when one is rate limited.
+func newProvider(p providerInfo, apiKey string) (Provider, error) {
+	if p.EnvVar == "" {
+		return p.New(""), nil
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv(p.EnvVar)
+	}
+	keys := splitList(apiKey)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s environment variable is not set", p.EnvVar)
+	}
+
+	var impls []Provider
+	for _, key := range keys {
+		secrets = append(secrets, key)
+		if p.Name == "anthropic" {
+			if warning := checkAPIKey(key); warning != "" {
+				info("Warning: %s", warning)
+			}
+		}
+		impls = append(impls, p.New(key))
+	}
+	if len(impls) == 1 {
+		return impls[0], nil
+	}
+	return &keyFailoverProvider{keys: impls}, nil
+}
+
+// keyFailoverProvider uses the first of several API keys for the same
+// provider, moving on to the next when one hits a rate limit or quota
+type keyFailoverProvider struct {
+	keys    []Provider
+	current int
+}
+
+func (k *keyFailoverProvider) Complete(model, prompt string, maxTokens int) (string, error) {
+	for {
+		debug("Using API key %d of %d", k.current+1, len(k.keys))
+		reply, err := k.keys[k.current].Complete(model, prompt, maxTokens)
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || k.current == len(k.keys)-1 {
+			return reply, err
+		}
+		k.current++
+		info("Warning: API key %d is rate limited, switching to key %d", k.current, k.current+1)
+	}
+}
+
+func (k *keyFailoverProvider) LastUsage() usage {
+	u, _ := lastUsage(k.keys[k.current])
+	return u
+}
+
+// fallbackProvider tries each provider of --providers in turn until one of
+// them replies. The first uses the requested model, the rest their default.
+type fallbackProvider struct {
+	chain []providerInfo
+	impls []Provider
+	// used is the name of the provider that produced the last reply
+	used     string
+	usedImpl Provider
+}
+
+// newFallbackProvider builds the chain from provider names, skipping any
+// whose credentials aren't set
+func newFallbackProvider(names []string) (*fallbackProvider, error) {
+	f := &fallbackProvider{}
+	for _, name := range names {
+		p, ok := lookupProvider(name)
+		if !ok {
+			return nil, usageError{fmt.Errorf("unsupported provider %q (supported: %s)", name, strings.Join(providerNames(), ", "))}
+		}
+		impl, err := newProvider(p, "")
+		if err != nil {
+			debug("Skipping provider %s: %v", name, err)
+			continue
+		}
+		f.chain = append(f.chain, p)
+		f.impls = append(f.impls, impl)
+	}
+	if len(f.chain) == 0 {
+		return nil, fmt.Errorf("none of the providers in --providers have credentials set")
+	}
+	return f, nil
+}
+
+func (f *fallbackProvider) Complete(model, prompt string, maxTokens int) (string, error) {
+	var errs []error
+	for i, p := range f.chain {
+		m := model
+		if i > 0 {
+			m = p.DefaultModel
+		}
+		reply, err := f.impls[i].Complete(m, prompt, maxTokens)
+		if err == nil {
+			f.used = fmt.Sprintf("%s (%s)", p.Name, m)
+			f.usedImpl = f.impls[i]
+			return reply, nil
+		}
+		if i < len(f.chain)-1 {
+			info("Warning: %s failed, falling back to %s: %v", p.Name, f.chain[i+1].Name, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+	}
+	// Joined rather than formatted, so exitCodeFor still sees the API errors
+	return "", fmt.Errorf("all providers failed:\n%w", errors.Join(errs...))
+}
+
+func (f *fallbackProvider) LastUsage() usage {
+	if f.usedImpl == nil {
+		return usage{}
+	}
+	u, _ := lastUsage(f.usedImpl)
+	return u
+}
+
+// postJSON sends payload as JSON and returns the response body, treating any
+// non-2xx status as an error
+func postJSON(url string, headers map[string]string, payload any) ([]byte, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w: %v", errCutOffResponse, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	debug("Received response from API (status %d)", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &apiError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(body))}
+	}
+	return body, nil
+}
+
+// parseResponse decodes a JSON response body. A body that's valid so far but
+// ends early is reported as errCutOffResponse rather than a parse error.
+func parseResponse(body []byte, v any) error {
+	err := json.Unmarshal(body, v)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) && syntaxErr.Offset >= int64(len(bytes.TrimSpace(body))) {
+		return fmt.Errorf("%w: %v", errCutOffResponse, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// errNothingToSplit means the staged changes are a single hunk, so
+// --auto-split falls back to a normal commit
+var errNothingToSplit = errors.New("nothing to split")
+
+// hunk is one "@@" section of a staged diff. Files that can't be split
+// (new, deleted, renamed, mode changes or binary) are a single hunk with an
+// empty Body.
+type hunk struct {
+	File   int    // index of the file in the diff
+	Path   string // path of the file, for the prompt
+	Header string // "diff --git" up to the first "@@"
+	Body   string // the "@@" line and its content
+}
+
+// splittableHeaderPrefixes are the only header lines of a plain modification.
+// Anything else (renames, mode changes, new files) has to stay in one piece,
+// since applying the header twice would fail.
+var splittableHeaderPrefixes = []string{"diff --git ", "index ", "--- ", "+++ "}
+
+// splitHunks breaks a staged diff into hunks that can be applied on their own
+func splitHunks(diff string) []hunk {
+	var hunks []hunk
+	for i, file := range splitDiff(diff) {
+		if strings.TrimSpace(file) == "" {
+			continue
+		}
+		path := diffPath(file)
+
+		start := strings.Index(file, "\n@@")
+		if start < 0 || !splittableHeader(file[:start+1]) {
+			hunks = append(hunks, hunk{File: i, Path: path, Header: file})
+			continue
+		}
+		header, body := file[:start+1], file[start+1:]
+
+		for _, line := range strings.SplitAfter(body, "\n") {
+			if strings.HasPrefix(line, "@@") {
+				hunks = append(hunks, hunk{File: i, Path: path, Header: header})
+			}
+			hunks[len(hunks)-1].Body += line
+		}
+	}
+	return hunks
+}
+
+func splittableHeader(header string) bool {
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+		ok := false
+		for _, prefix := range splittableHeaderPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// hunkPatch builds a patch containing only the given hunks, keeping them in
+// diff order with each file's header written once
+func hunkPatch(hunks []hunk, selected []int) string {
+	chosen := make(map[int]bool)
+	for _, n := range selected {
+		chosen[n] = true
+	}
+
+	var patch strings.Builder
+	lastFile := -1
+	for i, h := range hunks {
+		if !chosen[i+1] {
+			continue
+		}
+		if h.File != lastFile {
+			patch.WriteString(h.Header)
+			lastFile = h.File
+		}
+		patch.WriteString(h.Body)
+	}
+	return patch.String()
+}
+
+// splitMaxTokens is the reply budget for the grouping, which has a message
+// for every commit
+const splitMaxTokens = 2000
+
+// splitGroup is one commit suggested by the model
+type splitGroup struct {
+	Hunks   []int  `json:"hunks"`
+	Message string `json:"message"`
+}
+
+// buildSplitPrompt lists the hunks for the model. Binary files are described
+// by their path and size instead of git's binary patch, and new files
+// matching --skip-content-ext only by their path.
+func buildSplitPrompt(recentCommits string, hunks []hunk, binaries []binaryChange) string {
+	var listing strings.Builder
+	a := newAnonymizer()
+	s := stagedSanitizer()
+	for i, h := range hunks {
+		// Each hunk is cleaned with its file's header, which has the paths
+		// the commit:ignore regions are read from
+		header := strings.ToValidUTF8(normalizeNewlines(h.Header), "\uFFFD")
+		body := strings.TrimPrefix(s.clean(h.Header+h.Body), header)
+		if h.Body == "" {
+			body = s.clean(h.Header)
+		}
+		for _, b := range binaries {
+			if b.Path == h.Path {
+				body = "Binary file, no textual diff: " + describeBinary(b) + "\n"
+			}
+		}
+		if strings.Contains(h.Header, "\nnew file mode") && hasExtension(h.Path, splitList(skipContentExt)) {
+			body = "New file, its contents were left out\n"
+		}
+		if anonymizeMode {
+			body = a.diff(body)
+		}
+		fmt.Fprintf(&listing, "Hunk %d (%s):\n%s\n", i+1, h.Path, body)
+	}
+
+	return fmt.Sprintf(`The staged changes below are split into numbered hunks. Group them into as few well-scoped commits as makes sense, so that each commit is one logical change, and write a commit message for each.
+
+Each message uses conventional commit format (type: concise description) (the type must be one of: %s), optionally followed by a blank line and short, terse bullet points.
+
+Every hunk must be in exactly one commit. Order the commits so that each one makes sense on top of the previous ones.
+
+Return ONLY a JSON array, no introduction, no explanation, no code fences, like:
+[{"hunks": [1, 3], "message": "feat: add user auth\n\n- Add JWT tokens"}, {"hunks": [2], "message": "docs: document auth flow"}]
+
+Recent commits from this repo (for style reference):
+%s
+
+Hunks:
+%s`, strings.Join(commitTypes, ", "), recentCommits, listing.String())
+}
+
+// parseSplitPlan reads the model's JSON grouping and checks that it covers
+// every hunk exactly once
+func parseSplitPlan(reply string, hunkCount int) ([]splitGroup, error) {
+	reply = strings.TrimSpace(reply)
+	reply = strings.TrimPrefix(reply, "```json")
+	reply = strings.TrimPrefix(reply, "```")
+	reply = strings.TrimSuffix(reply, "```")
+
+	var groups []splitGroup
+	if err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &groups); err != nil {
+		return nil, fmt.Errorf("could not parse the suggested commits: %w", err)
+	}
+
+	seen := make(map[int]bool)
+	for _, g := range groups {
+		if len(g.Hunks) == 0 || strings.TrimSpace(g.Message) == "" {
+			return nil, fmt.Errorf("a suggested commit has no hunks or no message")
+		}
+		for _, n := range g.Hunks {
+			if n < 1 || n > hunkCount {
+				return nil, fmt.Errorf("suggested commits refer to hunk %d, but there are only %d", n, hunkCount)
+			}
+			if seen[n] {
+				return nil, fmt.Errorf("hunk %d is in more than one suggested commit", n)
+			}
+			seen[n] = true
+		}
+	}
+	if len(seen) != hunkCount {
+		return nil, fmt.Errorf("suggested commits cover %d of %d hunks", len(seen), hunkCount)
+	}
+	return groups, nil
+}
+
+// runAutoSplit asks the model to group the staged hunks into separate commits
+// and creates them one by one with git apply --cached
+func runAutoSplit(p Provider, providerName, model, branch string) error {
+	debug("Getting staged diff for --auto-split...")
+	// --binary is needed to apply the hunks again, but binary patches are
+	// only for git, the prompt describes binary files instead
+	diff, err := exec.Command("git", "diff", "--cached", "--binary").Output()
+	if err != nil {
+		return fmt.Errorf("error getting git diff: %w", err)
+	}
+	if len(diff) == 0 {
+		return errNothingStaged
+	}
+	if err := exec.Command("git", "rev-parse", "--verify", "-q", "HEAD").Run(); err != nil {
+		return fmt.Errorf("--auto-split needs at least one existing commit")
+	}
+
+	hunks := splitHunks(string(diff))
+	debug("Staged hunks: %d", len(hunks))
+	if len(hunks) < 2 {
+		return errNothingToSplit
+	}
+
+	binaries, _, err := stagedBinaryChanges()
+	if err != nil {
+		debug("Could not list binary files: %v", err)
+	}
+	recentCommits, err := recentCommitMessages()
+	if err != nil {
+		debug("Skipping recent commits, git log failed: %v", err)
+	}
+
+	prompt := buildSplitPrompt(string(recentCommits), hunks, binaries)
+	tokens := estimateTokens(prompt)
+	if err := checkPromptSize(tokens); err != nil {
+		return err
+	}
+	if err := checkCost(providerName, model, tokens, splitMaxTokens); err != nil {
+		return err
+	}
+
+	reply, err := complete(p, model, prompt, splitMaxTokens)
+	if err != nil {
+		return err
+	}
+	debug("Suggested split: %s", reply)
+	groups, err := parseSplitPlan(reply, len(hunks))
+	if err != nil {
+		return err
+	}
+	for i := range groups {
+		groups[i].Message = postProcess(groups[i].Message)
+	}
+
+	if dryRun {
+		for i, g := range groups {
+			fmt.Printf("Commit %d (hunks %v):\n%s\n\n", i+1, g.Hunks, g.Message)
+		}
+		return nil
+	}
+
+	if !quietMode || !autoAccept {
+		fmt.Fprintf(os.Stderr, "\nSuggested %d commits:\n", len(groups))
+		for i, g := range groups {
+			fmt.Fprintf(os.Stderr, "------------------ %d/%d (hunks %v)\n%s\n", i+1, len(groups), g.Hunks, g.Message)
+		}
+		fmt.Fprintln(os.Stderr, "------------------")
+	}
+	if !autoAccept && !confirm("Create these commits? [y/N] ") {
+		info("Aborted without committing.")
+		return errAborted
+	}
+
+	// Remember the full staged tree so it can be restored if anything fails
+	tree, err := exec.Command("git", "write-tree").Output()
+	if err != nil {
+		return fmt.Errorf("error saving the staged changes: %w", err)
+	}
+	restore := func(cause error) error {
+		if err := exec.Command("git", "read-tree", strings.TrimSpace(string(tree))).Run(); err != nil {
+			return fmt.Errorf("%w (restoring the remaining staged changes also failed: %v)", cause, err)
+		}
+		return fmt.Errorf("%w (the remaining changes are still staged)", cause)
+	}
+
+	if err := exec.Command("git", "read-tree", "HEAD").Run(); err != nil {
+		return fmt.Errorf("error unstaging changes: %w", err)
+	}
+	for i, g := range groups {
+		debug("Applying hunks %v", g.Hunks)
+		apply := exec.Command("git", "apply", "--cached", "-")
+		apply.Stdin = strings.NewReader(hunkPatch(hunks, g.Hunks))
+		if output, err := apply.CombinedOutput(); err != nil {
+			return restore(fmt.Errorf("error staging hunks %v: %w\n%s", g.Hunks, err, strings.TrimSpace(string(output))))
+		}
+		if err := commitChanges(g.Message); err != nil {
+			return restore(err)
+		}
+		recordHistory(historyEntry{Branch: branch, Model: model, Status: "accepted", Message: g.Message})
+		info("Created commit %d/%d: %s", i+1, len(groups), strings.SplitN(g.Message, "\n", 2)[0])
+	}
+	return nil
+}
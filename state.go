@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gitPath resolves a path inside the git directory. It goes through git
+// rather than assuming ".git/", which is a file in linked worktrees.
+func gitPath(name string) (string, error) {
+	output, err := exec.Command("git", "rev-parse", "--git-path", name).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func gitPathExists(name string) bool {
+	path, err := gitPath(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// inProgressOperation returns the multi-step git operation that is underway
+// ("rebase", "merge", "cherry-pick" or "revert"), or "" if there is none
+func inProgressOperation() string {
+	switch {
+	case gitPathExists("rebase-merge"), gitPathExists("rebase-apply"):
+		return "rebase"
+	case gitPathExists("MERGE_HEAD"):
+		return "merge"
+	case gitPathExists("CHERRY_PICK_HEAD"):
+		return "cherry-pick"
+	case gitPathExists("REVERT_HEAD"):
+		return "revert"
+	}
+	return ""
+}
+
+// rebaseMessagePath returns the file "git rebase --continue" takes the
+// commit message from, or "" if the rebase isn't using the merge backend
+func rebaseMessagePath() string {
+	if !gitPathExists("rebase-merge") {
+		return ""
+	}
+	path, err := gitPath("rebase-merge/message")
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// stagedFileContent returns the staged content of a file. The path is
+// relative to the top of the working tree, as git diff prints it, so it works
+// from subdirectories and linked worktrees, and it's what will be committed
+// even if the file was edited again after git add.
+func stagedFileContent(path string) ([]byte, error) {
+	return exec.Command("git", "show", ":"+path).Output()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// maxSubmoduleCommits caps how many commit subjects are listed per submodule
+const maxSubmoduleCommits = 10
+
+type submoduleChange struct {
+	Path string
+	// Name is the submodule's name in .gitmodules, when it differs from Path
+	Name string
+	Old  string // all zeros when the submodule was added
+	New  string // all zeros when the submodule was removed
+	// Commits are the subjects of Old..New, newest first, when the
+	// submodule is checked out and has both commits
+	Commits []string
+}
+
+// stagedSubmodules returns the submodules whose recorded commit changed
+func stagedSubmodules() ([]submoduleChange, error) {
+	output, err := exec.Command("git", "diff", "--cached", "--raw", "--no-abbrev").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := repoRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	names := submoduleNames(root)
+	var changes []submoduleChange
+	for _, line := range strings.Split(string(output), "\n") {
+		// e.g. ":160000 160000 <old sha> <new sha> M\tvendor/foo"
+		meta, path, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 5 || (fields[0] != ":160000" && fields[1] != "160000") {
+			continue
+		}
+		c := submoduleChange{Path: path, Old: fields[2], New: fields[3]}
+		if name := names[path]; name != path {
+			c.Name = name
+		}
+		if strings.Trim(c.Old, "0") != "" && strings.Trim(c.New, "0") != "" {
+			c.Commits = submoduleCommits(filepath.Join(root, path), c.Old, c.New)
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// submoduleNames maps submodule paths to their names in .gitmodules, which
+// are often more descriptive (e.g. "openssl" for "third_party/ssl")
+func submoduleNames(root string) map[string]string {
+	names := make(map[string]string)
+	output, err := exec.Command("git", "config", "-f", filepath.Join(root, ".gitmodules"), "--get-regexp", `^submodule\..*\.path$`).Output()
+	if err != nil {
+		return names
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		// e.g. "submodule.openssl.path third_party/ssl"
+		key, path, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		names[path] = strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+	}
+	return names
+}
+
+// submoduleCommits lists the subjects of the commits between two submodule
+// revisions, or nil if the submodule isn't checked out or lacks them
+func submoduleCommits(dir, old, new string) []string {
+	output, err := exec.Command("git", "-C", dir, "log", "--format=%s", fmt.Sprintf("-%d", maxSubmoduleCommits+1), old+".."+new).Output()
+	if err != nil {
+		debug("Could not read log of submodule %s: %v", dir, err)
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n")
+}
+
+func isSubmodule(changes []submoduleChange, path string) bool {
+	for _, c := range changes {
+		if c.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func submoduleSummary(changes []submoduleChange) string {
+	var sb strings.Builder
+	sb.WriteString("Submodule updates (the diff only shows commit hashes, so describe these using the commits below, e.g. \"chore: bump vendor/foo to abc1234 (fix auth)\"):\n")
+	for _, c := range changes {
+		label := c.Path
+		if c.Name != "" {
+			label = fmt.Sprintf("%s (submodule %s)", c.Path, c.Name)
+		}
+		switch {
+		case strings.Trim(c.Old, "0") == "":
+			fmt.Fprintf(&sb, "- %s added at %s\n", label, c.New[:7])
+			continue
+		case strings.Trim(c.New, "0") == "":
+			fmt.Fprintf(&sb, "- %s removed\n", label)
+			continue
+		}
+		fmt.Fprintf(&sb, "- %s moved from %s to %s", label, c.Old[:7], c.New[:7])
+		if len(c.Commits) == 0 || c.Commits[0] == "" {
+			sb.WriteString(" (commit subjects unavailable, the submodule may not be checked out or the update may go backwards)\n")
+			continue
+		}
+		sb.WriteString(", bringing in:\n")
+		for i, subject := range c.Commits {
+			if i == maxSubmoduleCommits {
+				sb.WriteString("  - ...and more\n")
+				break
+			}
+			fmt.Fprintf(&sb, "  - %s\n", subject)
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
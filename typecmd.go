@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runType implements the "type" subcommand, which prints only the
+// conventional commit type for the staged changes, for editor integrations
+// and scripts where the user writes the rest of the message
+func runType(p Provider, providerName, model string, args []string) error {
+	fs := flag.NewFlagSet("type", flag.ContinueOnError)
+	parseFlags(fs, args)
+
+	debug("Getting git diff for staged changes...")
+	diff, err := exec.Command("git", "diff", "--cached").Output()
+	if err != nil {
+		return fmt.Errorf("error getting git diff: %w", err)
+	}
+	if len(diff) == 0 {
+		return errNothingStaged
+	}
+	promptDiff, _ := preparePromptDiff(string(diff), stagedSanitizer())
+
+	prompt := fmt.Sprintf(`Pick the conventional commit type that best describes the staged changes below. It must be one of: %s
+
+Return ONLY the type, a single word, no explanation.
+
+Diff:
+%s`, strings.Join(commitTypes, ", "), promptDiff)
+	if err := checkPrompt(providerName, model, prompt, 10); err != nil {
+		return err
+	}
+
+	reply, err := complete(p, model, prompt, 10)
+	if err != nil {
+		return err
+	}
+	words := strings.Fields(strings.ToLower(reply))
+	if len(words) == 0 {
+		return errEmptyResponse
+	}
+	t := strings.Trim(words[0], "`'\".:")
+	for _, allowed := range commitTypes {
+		if t == allowed {
+			fmt.Println(t)
+			return nil
+		}
+	}
+	return fmt.Errorf("the model suggested %q, which isn't one of the allowed types (%s)", t, strings.Join(commitTypes, ", "))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+const latestReleaseURL = "https://api.github.com/repos/joehewett/commit/releases/latest"
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the named release asset
+func (r githubRelease) assetURL(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// runUpdate implements the "update" subcommand, which replaces the running
+// binary with the latest GitHub release after verifying its checksum
+func runUpdate(args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	checkOnly := fs.Bool("check-only", false, "Only report whether an update is available")
+	parseFlags(fs, args)
+
+	debug("Fetching latest release from %s", latestReleaseURL)
+	var release githubRelease
+	if err := getJSON(latestReleaseURL, &release); err != nil {
+		return fmt.Errorf("error checking for updates: %w", err)
+	}
+
+	if version != "dev" && compareVersions(release.TagName, version) <= 0 {
+		fmt.Fprintf(os.Stderr, "commit %s is up to date.\n", version)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "A new version is available: %s (current: %s)\n", release.TagName, version)
+	if *checkOnly {
+		return nil
+	}
+
+	asset := fmt.Sprintf("commit_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		asset += ".exe"
+	}
+	binaryURL, ok := release.assetURL(asset)
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", release.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	checksumsURL, ok := release.assetURL("checksums.txt")
+	if !ok {
+		return fmt.Errorf("release %s has no checksums.txt, refusing to update", release.TagName)
+	}
+
+	if !autoAccept && !confirm(fmt.Sprintf("Update to %s? [y/N] ", release.TagName)) {
+		fmt.Fprintln(os.Stderr, "Update cancelled.")
+		return errAborted
+	}
+
+	checksums, err := download(checksumsURL)
+	if err != nil {
+		return fmt.Errorf("error downloading checksums: %w", err)
+	}
+	want, ok := findChecksum(checksums, asset)
+	if !ok {
+		return fmt.Errorf("no checksum for %s in checksums.txt", asset)
+	}
+
+	debug("Downloading %s", binaryURL)
+	binary, err := download(binaryURL)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %w", asset, err)
+	}
+	sum := sha256.Sum256(binary)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", asset, want, got)
+	}
+
+	if err := replaceExecutable(binary); err != nil {
+		return fmt.Errorf("error replacing binary: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Updated to %s.\n", release.TagName)
+	return nil
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func getJSON(url string, v any) error {
+	body, err := download(url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// findChecksum looks up a file's SHA-256 in "<hash>  <name>" formatted
+// checksum lines, as written by sha256sum
+func findChecksum(checksums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// replaceExecutable swaps the running binary for the new one. Writing to a
+// temp file in the same directory and renaming keeps the swap atomic.
+func replaceExecutable(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".commit-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// compareVersions compares two "v1.2.3" style versions, returning -1, 0 or 1
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}